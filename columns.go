@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"github.com/AWildBeard/kismetDataTool/kismetClient"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A single column requested by the user. Filters may be followed by options that control how
+// the column is presented, for example
+//
+//	kismet.device.base.macaddr:as=mac:fmt=upper
+//	devices/first_time:as=first_seen:fmt=rfc3339
+//
+// `as` renames the column header and `fmt` applies one or more formatters to every value in
+// the column. Several formatters can be given either as a comma separated list or by repeating
+// the option. They are applied in the order they are given.
+type columnSpec struct {
+	// The filter that is handed to the kismet client
+	Filter string
+	// The header for the column. Empty to use the header reported by the client
+	Name string
+	// The names of the formatters, kept for reporting
+	FormatNames []string
+
+	formats []columnFormatter
+}
+
+// A formatter turns a value from a kismet client into the value that is written to the output
+type columnFormatter func(value interface{}) (interface{}, error)
+
+var columnFormatters = map[string]columnFormatter{
+	"rfc3339": formatRFC3339,
+	"local":   formatLocalTime,
+	"upper":   formatUpper,
+	"lower":   formatLower,
+	"colon":   macSeparatorFormatter(":"),
+	"dash":    macSeparatorFormatter("-"),
+	"bare":    macSeparatorFormatter(""),
+	"bytes":   formatBytes,
+	"hex":     formatHex,
+	"base64":  formatBase64,
+	"text":    formatText,
+}
+
+// Parses a space delineated list of column specifications.
+func parseColumnSpecs(filterSpec string) ([]columnSpec, error) {
+	specs := make([]columnSpec, 0)
+	for _, v := range strings.Fields(filterSpec) {
+		if spec, err := parseColumnSpec(v); err == nil {
+			specs = append(specs, spec)
+		} else {
+			return nil, err
+		}
+	}
+
+	return specs, nil
+}
+
+// Options are only recognized at the end of a spec, so filters that contain a `:` themselves
+// are left alone.
+func parseColumnSpec(spec string) (columnSpec, error) {
+	parts := strings.Split(spec, ":")
+	column := columnSpec{}
+
+	optionStart := len(parts)
+	for optionStart > 1 && isColumnOption(parts[optionStart-1]) {
+		optionStart--
+	}
+	column.Filter = strings.Join(parts[:optionStart], ":")
+
+	for _, option := range parts[optionStart:] {
+		keyValue := strings.SplitN(option, "=", 2)
+		switch keyValue[0] {
+		case "as":
+			if keyValue[1] == "" {
+				return column, fmt.Errorf("empty column name in %q", spec)
+			}
+			column.Name = keyValue[1]
+		case "fmt":
+			for _, name := range strings.Split(keyValue[1], ",") {
+				if formatter, err := lookupFormatter(name); err == nil {
+					column.formats = append(column.formats, formatter)
+					column.FormatNames = append(column.FormatNames, name)
+				} else {
+					return column, fmt.Errorf("%v in %q", err, spec)
+				}
+			}
+		}
+	}
+
+	return column, nil
+}
+
+func isColumnOption(part string) bool {
+	return strings.HasPrefix(part, "as=") || strings.HasPrefix(part, "fmt=")
+}
+
+func lookupFormatter(name string) (columnFormatter, error) {
+	if formatter, ok := columnFormatters[name]; ok {
+		return formatter, nil
+	}
+
+	// precN rounds coordinates to N decimal places
+	if strings.HasPrefix(name, "prec") {
+		if digits, err := strconv.Atoi(name[len("prec"):]); err == nil && digits >= 0 && digits <= 15 {
+			return precisionFormatter(digits), nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown formatter %q", name)
+}
+
+// Returns the filters that should be handed to the kismet clients
+func columnFilters(specs []columnSpec) []string {
+	filters := make([]string, len(specs))
+	for n, v := range specs {
+		filters[n] = v.Filter
+	}
+	return filters
+}
+
+// Returns the column spec for the column at index. Clients that have fixed columns may produce
+// more columns than the user specified. Those columns get no options.
+func columnAt(index int) columnSpec {
+	if index < len(columns) {
+		return columns[index]
+	}
+	return columnSpec{}
+}
+
+// Returns the headers for the output. Renamed columns replace the header from the client.
+func columnHeaders(client kismetClient.DataLineReader) []string {
+	headers := client.ElementHeaders()
+	named := make([]string, len(headers))
+	for n, v := range headers {
+		if name := columnAt(n).Name; name != "" {
+			named[n] = name
+		} else {
+			named[n] = v
+		}
+	}
+	return named
+}
+
+// Returns every value in the element in column order
+func elementValues(elem kismetClient.DataElement) []interface{} {
+	values := []interface{}{elem.Lat, elem.Lon, elem.ID}
+	if elem.HasExtraData() {
+		values = append(values, *elem.GetExtraData()...)
+	}
+	return values
+}
+
+// Runs each value of the element through the formatters of its column and returns the
+// values ready to be rendered.
+func formatElement(elem kismetClient.DataElement) ([]interface{}, error) {
+	values := elementValues(elem)
+	for n, v := range values {
+		for _, formatter := range columnAt(n).formats {
+			if formatted, err := formatter(v); err == nil {
+				v = formatted
+			} else {
+				return nil, fmt.Errorf("column %v: %v", n+1, err)
+			}
+		}
+		values[n] = v
+	}
+	return values, nil
+}
+
+// Renders a single value as text. Missing values become empty strings.
+func valueString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case float64: // Avoid exponents for large values such as frequencies
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// Formatters
+
+// Converts numbers of any kind (including numeric strings) to a float64
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case string:
+		if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+			return f, true
+		}
+	}
+	return 0, false
+}
+
+// Interprets the value as a unix epoch timestamp. Fractions of a second are kept.
+func toTime(value interface{}) (time.Time, error) {
+	if t, ok := value.(time.Time); ok {
+		return t, nil
+	}
+
+	if epoch, ok := toFloat(value); ok {
+		sec, frac := math.Modf(epoch)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+	return time.Time{}, fmt.Errorf("%v is not a timestamp", value)
+}
+
+func formatRFC3339(value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if t, err := toTime(value); err == nil {
+		return t.UTC().Format(time.RFC3339), nil
+	} else {
+		return nil, err
+	}
+}
+
+func formatLocalTime(value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if t, err := toTime(value); err == nil {
+		return t.Local().Format(time.RFC3339), nil
+	} else {
+		return nil, err
+	}
+}
+
+func precisionFormatter(digits int) columnFormatter {
+	return func(value interface{}) (interface{}, error) {
+		if value == nil {
+			return nil, nil
+		}
+		if f, ok := toFloat(value); ok {
+			return strconv.FormatFloat(f, 'f', digits, 64), nil
+		}
+		return nil, fmt.Errorf("%v is not a coordinate", value)
+	}
+}
+
+func formatUpper(value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	return strings.ToUpper(valueString(value)), nil
+}
+
+func formatLower(value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	return strings.ToLower(valueString(value)), nil
+}
+
+// Rewrites MAC addresses such as AA:BB:CC:DD:EE:FF, aa-bb-cc-dd-ee-ff or aabbccddeeff to use
+// the separator between each octet. Values that are not MAC addresses are left alone.
+func macSeparatorFormatter(separator string) columnFormatter {
+	return func(value interface{}) (interface{}, error) {
+		mac, ok := value.(string)
+		if !ok {
+			return value, nil
+		}
+
+		digits := strings.NewReplacer(":", "", "-", "", ".", "").Replace(mac)
+		if len(digits) != 12 {
+			return value, nil
+		}
+		for _, c := range digits {
+			if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+				return value, nil
+			}
+		}
+
+		octets := make([]string, 6)
+		for i := range octets {
+			octets[i] = digits[i*2 : i*2+2]
+		}
+		return strings.Join(octets, separator), nil
+	}
+}
+
+// Renders a byte count such as 1536 as 1.5 KiB
+func formatBytes(value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	size, ok := toFloat(value)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a number of bytes", value)
+	}
+
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	unit := 0
+	for math.Abs(size) >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%v %s", size, units[unit]), nil
+	}
+	return fmt.Sprintf("%.1f %s", size, units[unit]), nil
+}
+
+// Binary data is printed as hex by default. These formatters make that explicit, or switch to
+// base64, or treat the data as text (Kismet stores JSON in BLOB columns).
+func formatHex(value interface{}) (interface{}, error) {
+	if blob, ok := value.(kismetClient.Blob); ok {
+		return blob.String(), nil
+	}
+	return value, nil
+}
+
+func formatBase64(value interface{}) (interface{}, error) {
+	if blob, ok := value.(kismetClient.Blob); ok {
+		return blob.Base64(), nil
+	}
+	return value, nil
+}
+
+func formatText(value interface{}) (interface{}, error) {
+	if blob, ok := value.(kismetClient.Blob); ok {
+		return string(blob), nil
+	}
+	return value, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"github.com/AWildBeard/kismetDataTool/kismetClient"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Layouts accepted by -since and -until, besides unix epoch seconds. Layouts without a zone
+// are read as local time.
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+func parseTimeFlag(value string) (time.Time, error) {
+	if epoch, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(epoch, 0), nil
+	}
+
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("can not read %q as a time. Use RFC3339 (2006-01-02T15:04:05Z07:00), "+
+		"a local date and time (2006-01-02 15:04) or unix epoch seconds", value)
+}
+
+// Builds the row filter for DB mode from the command line flags
+func buildQueryFilter() (kismetClient.QueryFilter, error) {
+	filter := kismetClient.QueryFilter{
+		Phy:        filterPhy,
+		MACPrefix:  filterMACPrefix,
+		DeviceType: filterType,
+		Datasource: filterDatasource,
+	}
+
+	if filterSince != "" {
+		if since, err := parseTimeFlag(filterSince); err == nil {
+			filter.Since = since
+		} else {
+			return filter, fmt.Errorf("-since: %v", err)
+		}
+	}
+
+	if filterUntil != "" {
+		if until, err := parseTimeFlag(filterUntil); err == nil {
+			filter.Until = until
+		} else {
+			return filter, fmt.Errorf("-until: %v", err)
+		}
+	}
+
+	if !filter.Since.IsZero() && !filter.Until.IsZero() && filter.Until.Before(filter.Since) {
+		return filter, fmt.Errorf("-until is before -since")
+	}
+
+	if filterArea != "" {
+		if area, err := parseBoundingBox(filterArea); err == nil {
+			filter.Area = area
+		} else {
+			return filter, fmt.Errorf("-bbox: %v", err)
+		}
+	}
+
+	if filterMACs != "" {
+		if macs, err := parseMACList(filterMACs); err == nil {
+			filter.MACs = macs
+		} else {
+			return filter, fmt.Errorf("-macs: %v", err)
+		}
+	}
+
+	if filterMinSignal != "" {
+		if minSignal, err := strconv.Atoi(strings.TrimSpace(filterMinSignal)); err == nil {
+			filter.MinSignal = &minSignal
+		} else {
+			return filter, fmt.Errorf("-min-signal: %q is not a whole number of dBm", filterMinSignal)
+		}
+	}
+
+	return filter, nil
+}
+
+// Parses an area given as minLat,minLon,maxLat,maxLon
+func parseBoundingBox(value string) (*kismetClient.BoundingBox, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("%q is not minLat,minLon,maxLat,maxLon", value)
+	}
+
+	var corners [4]float64
+	for n, v := range parts {
+		if corner, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+			corners[n] = corner
+		} else {
+			return nil, fmt.Errorf("%q is not a coordinate", v)
+		}
+	}
+
+	area := &kismetClient.BoundingBox{MinLat: corners[0], MinLon: corners[1], MaxLat: corners[2], MaxLon: corners[3]}
+	if area.MinLat < -90 || area.MaxLat > 90 || area.MinLon < -180 || area.MaxLon > 180 {
+		return nil, fmt.Errorf("%q is not on Earth", value)
+	} else if area.MinLat > area.MaxLat || area.MinLon > area.MaxLon {
+		return nil, fmt.Errorf("the minimum corner of %q is past the maximum corner", value)
+	}
+
+	return area, nil
+}
+
+// Parses a comma separated list of MAC addresses, or reads them from a file when the value is
+// @ followed by the name of the file. The file has one MAC address on each line.
+func parseMACList(value string) ([]string, error) {
+	var entries []string
+	if strings.HasPrefix(value, "@") {
+		if contents, err := ioutil.ReadFile(value[1:]); err == nil {
+			entries = strings.Fields(string(contents))
+		} else {
+			return nil, err
+		}
+	} else {
+		entries = strings.Split(value, ",")
+	}
+
+	macs := make([]string, 0, len(entries))
+	for _, v := range entries {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+
+		if mac, err := kismetClient.NormalizeMAC(v); err == nil {
+			macs = append(macs, mac)
+		} else {
+			return nil, err
+		}
+	}
+
+	if len(macs) == 0 {
+		return nil, fmt.Errorf("no MAC addresses in %q", value)
+	}
+
+	return macs, nil
+}
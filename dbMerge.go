@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"github.com/AWildBeard/kismetDataTool/kismetClient"
+	"path/filepath"
+	"strings"
+)
+
+// The -dbFile flag can be given more than once, and each value may be a glob such as
+// `logs/*.kismet`
+type fileList []string
+
+func (files *fileList) String() string {
+	return strings.Join(*files, " ")
+}
+
+func (files *fileList) Set(value string) error {
+	*files = append(*files, value)
+	return nil
+}
+
+// Expands the globs in the -dbFile values. Values that aren't globs are kept as they are so that
+// a missing file is reported as missing. Files named more than once are only read once. Also
+// reports whether the files are merged, which they are when more than one value is given or any
+// value is a glob. A glob is merged even when it matches a single file, so that the same command
+// always produces the same kind of export however many files the glob finds.
+func expandDBFiles(patterns []string) ([]string, bool, error) {
+	var (
+		files []string
+		seen = make(map[string]bool)
+		merge = len(patterns) > 1
+	)
+
+	for _, pattern := range patterns {
+		matches := []string{pattern}
+		if strings.ContainsAny(pattern, "*?[") {
+			merge = true
+			if globbed, err := filepath.Glob(pattern) ; err == nil && len(globbed) > 0 {
+				matches = globbed
+			} else if err != nil {
+				return nil, false, fmt.Errorf("bad -dbFile pattern %q: %v", pattern, err)
+			} else {
+				return nil, false, fmt.Errorf("no files match %q", pattern)
+			}
+		}
+
+		for _, v := range matches {
+			if !seen[v] {
+				seen[v] = true
+				files = append(files, v)
+			}
+		}
+	}
+
+	return files, merge, nil
+}
+
+// Merges the devices of every -dbFile into one export
+func doMerge() error {
+	dlog.Println("Creating Kismet client")
+
+	mergeClient, err := kismetClient.NewMergeClient(kismetDBFiles)
+	if err != nil {
+		dlog.Println("Failed to open the databases:", err)
+		ilog.Println("Failed to read database:", err)
+		return err
+	}
+	defer mergeClient.Finish()
+
+	mergeClient.Filter = dbFilter
+	mergeClient.Location = mergeLocation
+
+	source := sourceInfo{Type: "kismetdb"}
+	for _, v := range mergeClient.Sources {
+		source.Files = append(source.Files, sourceFile{v.File, v.KismetVersion, v.DBVersion})
+	}
+	provenance.setSource(source)
+
+	return exportTable(&mergeClient)
+}
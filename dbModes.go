@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"github.com/AWildBeard/kismetDataTool/kismetClient"
+	"strings"
+)
+
+// The modes that can also read from the Kismet REST API
+var restExportModes = []string{"alerts"}
+
+// The modes that export one of the kismetdb tables with a fixed set of columns, rather than the
+// columns picked with -filter, are those of tableModes and modeRunners
+func validMode(mode string) bool {
+	_, isTable := tableModes[mode]
+	_, isRunner := modeRunners[mode]
+	return isTable || isRunner
+}
+
+func validRestMode(mode string) bool {
+	return hasMode(restExportModes, mode)
+}
+
+// Returns the format the mode writes itself, or nothing if its rows are written with the chosen
+// output format. Databases are named after the mode that writes them.
+func modeFormat(mode string) string {
+	switch mode {
+	case "pcapng", "subset", "sanitize", "recover":
+		return mode
+	case "tracks":
+		return "kml"
+	}
+	return ""
+}
+
+func hasMode(modes []string, mode string) bool {
+	for _, v := range modes {
+		if v == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// In the modes with fixed columns, -filter is only used to rename and format columns. Each
+// spec names one of the columns of the mode, such as `timestamp:fmt=local`. This lines the specs
+// up with the columns of the client so that they can be found by position like in the other modes.
+func alignColumnSpecs(specs []columnSpec, headers []string) ([]columnSpec, error) {
+	aligned := make([]columnSpec, len(headers))
+	for _, spec := range specs {
+		found := false
+		for n, v := range headers {
+			if spec.Filter == v {
+				aligned[n] = spec
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("no column %q. The columns are: %v", spec.Filter, strings.Join(headers, ", "))
+		}
+	}
+
+	return aligned, nil
+}
+
+// The modes that do more than write the rows of a table, and write their output themselves
+var modeRunners = map[string]func() error{
+	"inspect":  doInspect,
+	"pcapng":   doPcapng,
+	"subset":   doSubset,
+	"sanitize": doSanitize,
+	"recover":  doRecover,
+	"tracks":   doTracks,
+}
+
+// A client of one of the kismetdb tables
+type tableModeClient interface {
+	kismetClient.DataLineReader
+	Versions() (string, int)
+	Finish() error
+}
+
+// Opens the clients of the modes that write the rows of a table with the chosen output, set up
+// with the options of the mode
+var tableModes = map[string]func() (tableModeClient, error){
+	"packets": func() (tableModeClient, error) {
+		client, err := kismetClient.NewPacketClient(kismetDB)
+		client.Filter = dbFilter
+		client.SampleEvery = sampleEvery
+		client.SampleInterval = sampleInterval
+		return &client, err
+	},
+	"alerts": func() (tableModeClient, error) {
+		client, err := kismetClient.NewAlertClient(kismetDB)
+		client.Filter = dbFilter
+		return &client, err
+	},
+	"datasources": func() (tableModeClient, error) {
+		client, err := kismetClient.NewDatasourceClient(kismetDB)
+		client.Filter = dbFilter
+		return &client, err
+	},
+	"messages": func() (tableModeClient, error) {
+		client, err := kismetClient.NewMessageClient(kismetDB)
+		client.Filter = dbFilter
+		return &client, err
+	},
+	"data": func() (tableModeClient, error) {
+		client, err := kismetClient.NewDataClient(kismetDB)
+		client.Filter = dbFilter
+		return &client, err
+	},
+	"snapshots": func() (tableModeClient, error) {
+		client, err := kismetClient.NewSnapshotClient(kismetDB)
+		client.Filter = dbFilter
+		return &client, err
+	},
+}
+
+// Runs the export for one of the table modes
+func doMode(mode string) error {
+	dlog.Println("Creating Kismet client")
+
+	if run, ok := modeRunners[mode]; ok {
+		return run()
+	}
+
+	open, ok := tableModes[mode]
+	if !ok {
+		return fmt.Errorf("unknown mode %q", mode)
+	}
+
+	client, err := open()
+	if err != nil {
+		dlog.Println("Failed to create a DB Connection:", err)
+		ilog.Println("Failed to read database:", err)
+		return err
+	}
+	defer client.Finish()
+
+	kismetVersion, dbVersion := client.Versions()
+	return exportDBTable(client, kismetVersion, dbVersion)
+}
+
+// Runs the export for one of the modes that read from the Kismet REST API
+func doRestMode(mode string) error {
+	var (
+		kClient kismetClient.KismetRestClient
+	)
+
+	if newKClient, err := connectRest(nil) ; err == nil {
+		kClient = newKClient
+		defer kClient.Finish()
+	} else {
+		return err
+	}
+
+	switch mode {
+	case "alerts":
+		alertClient := kismetClient.NewRestAlertClient(&kClient)
+		return exportTable(&alertClient)
+	}
+
+	return fmt.Errorf("unknown mode %q", mode)
+}
+
+// Records the database as the source of the export and writes the elements of a table client
+func exportDBTable(client kismetClient.DataLineReader, kismetVersion string, dbVersion int) error {
+	provenance.setSource(sourceInfo{
+		Type:          "kismetdb",
+		Path:          kismetDB,
+		KismetVersion: kismetVersion,
+		DBVersion:     dbVersion,
+	})
+
+	return exportTable(client)
+}
+
+// Writes the elements of a table client with the chosen output
+func exportTable(client kismetClient.DataLineReader) error {
+	dlog.Println("Created Kismet client")
+
+	if aligned, err := alignColumnSpecs(columns, client.ElementHeaders()); err == nil {
+		columns = aligned
+	} else {
+		ilog.Println("Bad filter:", err)
+		return err
+	}
+
+	if err := outputFunc(client); err != nil {
+		dlog.Println("Error writing output:", err)
+		ilog.Println("Failed to export data:", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"github.com/AWildBeard/kismetDataTool/kismetClient"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Keeps writing the rows that are added to the table after the first export until the program
+// is interrupted. Interrupting it finishes the export normally, so the output and its metadata
+// are complete up to the last row written.
+func follow(client *kismetClient.KismetDBClient) error {
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupted)
+
+	ticker := time.NewTicker(followInterval)
+	defer ticker.Stop()
+
+	dlog.Println("Following", kismetDB, "every", followInterval)
+	for {
+		// Whoever is reading the output sees each batch of rows as soon as it is read
+		if err := sink.Flush() ; err != nil {
+			return err
+		}
+
+		select {
+		case <-interrupted:
+			dlog.Println("Stopped following")
+			return nil
+		case <-ticker.C:
+		}
+
+		generator, err := client.Elements()
+		if err == nil {
+			err = writeCsvElements(generator)
+		}
+
+		if _, isReadError := err.(kismetClient.KismetDBError) ; isReadError {
+			// Kismet may be holding the database for longer than the busy timeout. The cursor
+			// only moves past rows that were returned, so the rest are read again next time.
+			fmt.Fprintln(os.Stderr, "Failed to read new rows, trying again:", err)
+		} else if err != nil {
+			// Trying again won't help a full disk, a reader that went away or a row that can't
+			// be decoded
+			return err
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"github.com/AWildBeard/kismetDataTool/kismetClient"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Describes the layout and contents of the -dbFile database. The report is written as text to
+// the output, whatever the output format.
+func doInspect() error {
+	dlog.Println("Inspecting", kismetDB)
+
+	report, err := kismetClient.InspectDB(kismetDB)
+	if err != nil {
+		dlog.Println("Failed to inspect the database:", err)
+		ilog.Println("Failed to read database:", err)
+		return err
+	}
+
+	provenance.setSource(sourceInfo{
+		Type:          "kismetdb",
+		Path:          kismetDB,
+		KismetVersion: report.KismetVersion,
+		DBVersion:     report.DBVersion,
+	})
+
+	writer := tabwriter.NewWriter(sink, 0, 4, 2, ' ', 0)
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(writer, format + "\n", args...)
+	}
+
+	line("%s", kismetDB)
+	line("  Kismet version\t%s", report.KismetVersion)
+	line("  DB version\t%d", report.DBVersion)
+	if report.FirstTime.IsZero() {
+		line("  Time range\tunknown")
+	} else {
+		line("  Time range\t%s to %s", report.FirstTime.Format(time.RFC3339), report.LastTime.Format(time.RFC3339))
+	}
+	line("  Packets with GPS fix\t%s", coverage(report.PacketsWithFix, report.Packets))
+	line("  Devices with GPS fix\t%s", coverage(report.DevicesWithFix, report.Devices))
+	line("  PHYs\t%s", strings.Join(report.Phys, ", "))
+
+	for _, table := range report.Tables {
+		line("")
+		line("%s (%d rows)", table.Name, table.Rows)
+		for _, column := range table.Columns {
+			line("  %s/%s\t%s", table.Name, column.Name, column.Type)
+		}
+	}
+
+	if report.DeviceSamples > 0 {
+		line("")
+		line("JSON fields in devices (found in %d sampled devices)", report.DeviceSamples)
+		for _, field := range report.DeviceFields {
+			line("  devices/%s\t%d", field.Path, field.Records)
+		}
+	}
+
+	return writer.Flush()
+}
+
+// Formats how many of a total have something, such as a GPS fix
+func coverage(count, total int64) string {
+	if total == 0 {
+		return "0 of 0"
+	}
+	return fmt.Sprintf("%d of %d (%.1f%%)", count, total, float64(count) * 100 / float64(total))
+}
@@ -1,11 +1,19 @@
 package kismetClient
 
+import (
+	"encoding/base64"
+	"encoding/hex"
+)
+
 type DataLineReader interface {
 	// Returns a function that returns a unique, not previously seen data element.
 	// The data element must at least include a latitude, longitude, and ID.
 	// The data element may include any kind of extra data that will be stored
 	// into a generic interface{} array. The extra data will by typed to a string
 	// and stored into the description element of the KML sheet.
+	// Once there are no more elements, the generator returns an element with HasData
+	// unset and a nil error. Any error returned by the generator means that the data
+	// could not be read completely.
 	Elements() (func() (DataElement, error), error)
 	ElementHeaders() []string
 }
@@ -28,9 +36,10 @@ type DataElement struct {
 }
 
 // If the generator that generated this Data Element had extra data either from more queries or otherwise,
-// this function will expose that extra data to the caller. The data in the []interface{} will be pointers
-// to typed data retrieved directly from the database call. By typed data I mean that it is data that has
-// been converted into the go type system.
+// this function will expose that extra data to the caller. The data in the []interface{} will be typed
+// data retrieved directly from the database call. By typed data I mean that it is data that has
+// been converted into the go type system. Missing values (such as NULL columns) are nil, and binary
+// data is a Blob.
 func (elem *DataElement) GetExtraData() *[]interface{} {
 	return &elem.data
 }
@@ -38,3 +47,14 @@ func (elem *DataElement) GetExtraData() *[]interface{} {
 func (elem *DataElement) HasExtraData() bool {
 	return elem.extraData
 }
+
+// Binary data, such as a BLOB column from a Kismet database. It is printed as hex.
+type Blob []byte
+
+func (blob Blob) String() string {
+	return hex.EncodeToString(blob)
+}
+
+func (blob Blob) Base64() string {
+	return base64.StdEncoding.EncodeToString(blob)
+}
@@ -1,6 +1,13 @@
 package kismetClient
 
-import "database/sql"
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Kismet stores coordinates as integers in some databases. Those are scaled by this much.
+const coordinateScale = 100000
 
 type KismetDBError string
 
@@ -8,14 +15,104 @@ func (err KismetDBError) Error() string {
 	return string(err)
 }
 
+// A row that was read from the database but can't be turned into an element. Reading it again
+// fails the same way.
+type KismetRowError string
+
+func (err KismetRowError) Error() string {
+	return string(err)
+}
+
 func (client KismetDBClient) GetRawRows() *sql.Rows {
 	return client.rows
 }
 
 func (client *KismetDBClient) Finish() error {
+	client.Ready = false
+	if client.stop != nil {
+		close(client.stop)
+		client.stop = nil
+	}
+	if client.rows != nil {
+		client.rows.Close()
+	}
+	return client.db.Close()
+}
+
+func (client *KismetSQLClient) Finish() error {
 	client.Ready = false
 	if client.rows != nil {
 		client.rows.Close()
 	}
 	return client.db.Close()
 }
+
+// The merge client opens each file only while it is reading it
+func (client *KismetMergeClient) Finish() error {
+	client.Ready = false
+	return nil
+}
+
+// Reads the version of Kismet that created the database and the version of the database
+// layout from the KISMET table.
+func readKismetVersion(db *sql.DB) (string, int, error) {
+	var (
+		kismetVersion string
+		dbVersion int
+	)
+
+	row := db.QueryRow("select kismet_version, db_version from KISMET limit 1;")
+	if err := row.Scan(&kismetVersion, &dbVersion) ; err != nil {
+		return "", 0, KismetDBError(fmt.Sprint("Failed to read the KISMET table: ", err))
+	}
+
+	return kismetVersion, dbVersion, nil
+}
+
+// Returns a value to scan a column into. SQLite is dynamically typed, so a column can hold values
+// of any type whatever its declared type says, such as a REAL in an INT column. Scanning into a
+// type picked from the declared type would fail on those, so the value is scanned as it is.
+func scanTarget() interface{} {
+	return new(interface{})
+}
+
+// Converts a value scanned into a target from scanTarget() into a plain Go value. NULLs become nil,
+// integers int64, reals float64, text string and blobs Blob.
+func scannedValue(target interface{}) interface{} {
+	value := *target.(*interface{})
+	switch v := value.(type) {
+	case []byte:
+		return Blob(v)
+	case bool: // The driver reads columns declared BOOLEAN as bools
+		if v {
+			return int64(1)
+		}
+		return int64(0)
+	}
+	return value
+}
+
+// Columns can reach into the JSON record stored in a column, such as
+// device:dot11.device/dot11.device.last_beaconed_ssid. Returns the name of the column in the
+// database and the path of the field in the record, if there is one.
+func splitDBColumn(column string) (string, []string) {
+	parts := strings.SplitN(column, ":", 2)
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+	return parts[0], splitFieldPath(parts[1])
+}
+
+// Returns a number as a float64. Missing numbers are 0.
+func numberValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case nil:
+		return 0, true
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,97 @@
+package kismetClient
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The columns that enriching a devices query adds after the chosen columns. They summarise what
+// the other tables recorded about each device, which the devices table itself averages away.
+var enrichHeaders = []string{
+	// How many packets the device sent, and their signal in dBm
+	"packets", "min_signal", "max_signal", "avg_signal",
+	// Where the first and last packets captured with a GPS fix were seen
+	"first_lat", "first_lon", "last_lat", "last_lon",
+	// The names of the datasources that saw the device, comma separated
+	"datasources",
+	// How many records the device has in the data table
+	"data_records",
+}
+
+// Returns true if the enrichment column holds a coordinate
+func isEnrichCoordinate(column string) bool {
+	return strings.HasSuffix(column, "_lat") || strings.HasSuffix(column, "_lon")
+}
+
+// Builds the select list and joins that add the enrichHeaders columns to a query of the devices
+// table. Each join is a subquery grouped by the MAC address and PHY of the sender, which together
+// identify a device in Kismet. Devices that never appear in a table get 0 counts and NULLs.
+func enrichDevices(schema *KismetSchema) (string, string, error) {
+	var (
+		devices = schema.Table("devices")
+		packets = schema.Table("packets")
+		data = schema.Table("data")
+		sources = schema.Table("datasources")
+	)
+
+	// Every identifier is quoted up front so that the statements below can be read as SQL
+	quoted := make(map[string]string)
+	for _, v := range []string{
+		devices.Name, devices.MAC, devices.Phy,
+		packets.Name, packets.MAC, packets.Phy, packets.Signal, packets.Lat, packets.Lon,
+		packets.FirstTime, packets.SubTime, packets.Datasource,
+		data.Name, data.MAC, data.Phy,
+		sources.Name, "uuid", "name",
+	} {
+		if q, err := quoteIdentifier(v) ; err == nil {
+			quoted[v] = q
+		} else {
+			return "", "", err
+		}
+	}
+
+	// Joins a subquery that has a mac and phy column to the devices table
+	join := func(subquery, alias string) string {
+		return fmt.Sprintf(" left join (%s) as %s on %s.mac = %s.%s and %s.phy = %s.%s",
+			subquery, alias, alias, quoted[devices.Name], quoted[devices.MAC], alias, quoted[devices.Name],
+			quoted[devices.Phy])
+	}
+
+	// Packets are the largest table by far, so everything about them is read in two passes: one
+	// for the counts, signals and datasources and one for the fixes. Kismet records a signal of 0
+	// when the datasource couldn't measure it. Datasources are named where the datasources table
+	// knows them, and by their UUID otherwise.
+	signal := fmt.Sprintf("nullif(packet.%s, 0)", quoted[packets.Signal])
+	packetStats := fmt.Sprintf("select packet.%s as mac, packet.%s as phy, count(*) as packets, "+
+		"min(%s) as min_signal, max(%s) as max_signal, avg(%s) as avg_signal, "+
+		"group_concat(distinct coalesce(source.name, packet.%s)) as datasources "+
+		"from %s as packet left join (select %s as uuid, min(%s) as name from %s group by uuid) as source "+
+		"on source.uuid = packet.%s group by mac, phy",
+		quoted[packets.MAC], quoted[packets.Phy], signal, signal, signal, quoted[packets.Datasource],
+		quoted[packets.Name], quoted["uuid"], quoted["name"], quoted[sources.Name], quoted[packets.Datasource])
+
+	// The packets with a fix of each device are put in the order they were captured, and the first
+	// row of each device holds the positions of both its first and last fix
+	fixes := fmt.Sprintf("select mac, phy, first_lat, first_lon, last_lat, last_lon from "+
+		"(select %s as mac, %s as phy, row_number() over capture as n, "+
+		"first_value(%s) over capture as first_lat, first_value(%s) over capture as first_lon, "+
+		"last_value(%s) over capture as last_lat, last_value(%s) over capture as last_lon "+
+		"from %s where %s window capture as (partition by %s, %s order by %s, %s "+
+		"rows between unbounded preceding and unbounded following)) where n = 1",
+		quoted[packets.MAC], quoted[packets.Phy], quoted[packets.Lat], quoted[packets.Lon], quoted[packets.Lat],
+		quoted[packets.Lon], quoted[packets.Name], gpsFixCondition(packets), quoted[packets.MAC],
+		quoted[packets.Phy], quoted[packets.FirstTime], quoted[packets.SubTime])
+
+	dataStats := fmt.Sprintf("select %s as mac, %s as phy, count(*) as data_records from %s group by mac, phy",
+		quoted[data.MAC], quoted[data.Phy], quoted[data.Name])
+
+	selectList := "coalesce(packet_stats.packets, 0), packet_stats.min_signal, packet_stats.max_signal, " +
+		"packet_stats.avg_signal, fixes.first_lat, fixes.first_lon, fixes.last_lat, fixes.last_lon, " +
+		"packet_stats.datasources, coalesce(data_stats.data_records, 0)"
+
+	joins := join(packetStats, "packet_stats") +
+		join(fixes, "fixes") +
+		join(dataStats, "data_stats")
+
+	return selectList, joins, nil
+}
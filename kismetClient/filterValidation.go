@@ -0,0 +1,403 @@
+package kismetClient
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// How many values are read from a column to see if it holds coordinates
+const coordinateSampleSize = 1000
+
+// The most names suggested for a misspelled one
+const maxSuggestions = 3
+
+// Checks the table and columns of the client against the database before anything is read, so
+// that mistakes are reported with what was probably meant instead of as a failed query. Returns
+// an error for tables and columns that don't exist. Returns warnings for JSON fields that none
+// of a sample of the records have, and for latitude and longitude columns that don't look like
+// they hold coordinates, as exporting them may still be what was meant.
+func (client *KismetDBClient) Validate() ([]string, error) {
+	if len(client.Columns) == 0 {
+		return nil, nil // Reported when the query is run
+	}
+
+	tables, err := tableNames(client.db)
+	if err != nil {
+		return nil, err
+	}
+	if !containsName(tables, client.Table) {
+		return nil, KismetDBError(fmt.Sprintf("The database has no %s table.%s Its tables are: %s",
+			client.Table, didYouMean(suggestNames(client.Table, tables)), strings.Join(tables, ", ")))
+	}
+
+	columns, err := tableColumnReports(client.db, client.Table)
+	if err != nil {
+		return nil, err
+	}
+	columnNames := make([]string, len(columns))
+	declaredTypes := make(map[string]string)
+	for i, v := range columns {
+		columnNames[i] = v.Name
+		declaredTypes[strings.ToLower(v.Name)] = v.Type
+	}
+
+	var (
+		problems []string
+		warnings []string
+	)
+
+	for i, v := range client.Columns {
+		name, path := splitDBColumn(v)
+		if !containsName(columnNames, name) {
+			problem := fmt.Sprintf("%s has no column %q.", client.Table, name)
+			if suggestions := suggestNames(name, columnNames); len(suggestions) > 0 {
+				for n := range suggestions {
+					suggestions[n] = client.Table + "/" + suggestions[n]
+				}
+				problem += didYouMean(suggestions)
+			} else if others := otherTablesWith(client.db, tables, client.Table, name); len(others) > 0 {
+				problem += fmt.Sprintf(" It is a column of %s, but every -filter column must come from the same table.",
+					strings.Join(others, ", "))
+			}
+			problems = append(problems, problem)
+			continue
+		}
+
+		var values []interface{}
+		if path != nil {
+			found, records, present, err := client.sampleField(name, path)
+			if err != nil {
+				return nil, err
+			}
+			if records > 0 && present == 0 {
+				warning := fmt.Sprintf("None of the first %d %s records have the field %s.", records,
+					name, v)
+				warning += didYouMean(suggestNames(v, found))
+				warnings = append(warnings, warning)
+			}
+			if i < 2 {
+				if values, err = client.sampleValues(name, path) ; err != nil {
+					return nil, err
+				}
+			}
+		} else if i < 2 {
+			if declared := declaredTypes[strings.ToLower(name)]; textAffinity(declared) {
+				warnings = append(warnings, fmt.Sprintf("%s/%s is declared %s, which doesn't look like a %s column.",
+					client.Table, name, declared, coordinateNames[i]))
+			}
+			if values, err = client.sampleValues(name, nil) ; err != nil {
+				return nil, err
+			}
+		}
+
+		if i < 2 {
+			if warning := implausibleCoordinates(v, i, values, client.Schema, path == nil); warning != "" {
+				warnings = append(warnings, warning)
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return warnings, KismetDBError(strings.Join(problems, "\n"))
+	}
+
+	if len(client.Columns) >= 2 {
+		first, _ := splitDBColumn(client.Columns[0])
+		second, _ := splitDBColumn(client.Columns[1])
+		if looksLike(first, "lon") && looksLike(second, "lat") {
+			warnings = append(warnings, fmt.Sprintf("The latitude goes first and the longitude second, but %s and %s look like they are the other way around.",
+				first, second))
+		}
+	}
+
+	return warnings, nil
+}
+
+// The coordinates the first two columns must hold
+var coordinateNames = []string{"latitude", "longitude"}
+
+// The largest value of each coordinate
+var coordinateLimits = []float64{90, 180}
+
+// Returns a warning if the values read from the latitude (position 0) or longitude (position 1)
+// column can't be coordinates. Values read from a column rather than from a JSON field are
+// decoded the way this version of the database stores coordinates.
+func implausibleCoordinates(column string, position int, values []interface{}, schema *KismetSchema, decode bool) string {
+	var (
+		min, max float64
+		numbers int
+	)
+
+	for _, v := range values {
+		var (
+			coordinate float64
+			ok = true
+		)
+		if decode {
+			var err error
+			coordinate, err = schema.Coordinate(v)
+			ok = err == nil
+		} else {
+			coordinate, ok = numberValue(v)
+		}
+
+		if !ok {
+			return fmt.Sprintf("%s holds values such as %q that aren't %ss, so reading it will fail.", column,
+				fmt.Sprint(v), coordinateNames[position])
+		}
+
+		if numbers == 0 || coordinate < min {
+			min = coordinate
+		}
+		if numbers == 0 || coordinate > max {
+			max = coordinate
+		}
+		numbers++
+	}
+
+	limit := coordinateLimits[position]
+	if numbers > 0 && (min < -limit || max > limit) {
+		return fmt.Sprintf("%s holds values from %v to %v, but a %s is between -%v and %v.", column, min, max,
+			coordinateNames[position], limit, limit)
+	}
+
+	return ""
+}
+
+// Reads up to coordinateSampleSize values of a column, or of a field of the JSON records in a
+// column. Kismet uses 0 for a missing coordinate, so those are left out along with NULLs.
+func (client *KismetDBClient) sampleValues(column string, path []string) ([]interface{}, error) {
+	var values []interface{}
+
+	err := client.sampleColumn(column, func(value interface{}) error {
+		if path != nil {
+			record, err := decodeJSONRecord(value)
+			if err != nil {
+				return nil // Not every record has to be valid to see what the column holds
+			}
+			value = fieldAt(record, path)
+		}
+
+		if number, ok := numberValue(value); value != nil && !(ok && number == 0) {
+			values = append(values, value)
+		}
+		return nil
+	})
+
+	return values, err
+}
+
+// Reads a sample of the JSON records in a column. Returns the paths of the fields found in the
+// records, how many records were read and how many of them have the field at path.
+func (client *KismetDBClient) sampleField(column string, path []string) ([]string, int, int, error) {
+	var (
+		found = make(map[string]bool)
+		records, present int
+	)
+
+	err := client.sampleColumn(column, func(value interface{}) error {
+		record, err := decodeJSONRecord(value)
+		if err != nil || record == nil {
+			return nil
+		}
+
+		records++
+		if fieldAt(record, path) != nil {
+			present++
+		}
+		if records <= inspectSampleSize {
+			collectFields(record, column + ":", found)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	paths := make([]string, 0, len(found))
+	for v := range found {
+		paths = append(paths, v)
+	}
+	sort.Strings(paths)
+
+	return paths, records, present, nil
+}
+
+// Calls read with each value of a sample of the rows of a column that aren't NULL. The sample is
+// the first rows of the table, which is much faster than a random sample on large tables.
+func (client *KismetDBClient) sampleColumn(column string, read func(value interface{}) error) error {
+	quotedTable, err := quoteIdentifier(client.Table)
+	if err != nil {
+		return err
+	}
+	quotedColumn, err := quoteIdentifier(column)
+	if err != nil {
+		return err
+	}
+
+	rows, err := client.db.Query(fmt.Sprintf("select %s from %s where %s is not null limit %d;", quotedColumn,
+		quotedTable, quotedColumn, coordinateSampleSize))
+	if err != nil {
+		return KismetDBError(fmt.Sprint("Failed to read ", client.Table, "/", column, ": ", err))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var value interface{}
+		if err := rows.Scan(&value) ; err != nil {
+			return KismetDBError(fmt.Sprint("Failed to read ", client.Table, "/", column, ": ", err))
+		}
+		if raw, isBlob := value.([]byte); isBlob {
+			value = Blob(raw)
+		}
+
+		if err := read(value) ; err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err() ; err != nil {
+		return KismetDBError(fmt.Sprint("Failed to read ", client.Table, "/", column, ": ", err))
+	}
+	return nil
+}
+
+// Returns the other tables that have a column of this name
+func otherTablesWith(db *sql.DB, tables []string, table, column string) []string {
+	var others []string
+	for _, v := range tables {
+		if v == table {
+			continue
+		}
+
+		if columns, err := tableColumns(db, v) ; err == nil && containsName(columns, column) {
+			others = append(others, v)
+		}
+	}
+	return others
+}
+
+// SQLite compares table and column names without regard to case
+func containsName(names []string, name string) bool {
+	for _, v := range names {
+		if strings.EqualFold(v, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true for declared types that SQLite stores as text or leaves untyped, following its
+// rules for the affinity of a column. Columns without a declared type are left out, as they can
+// hold anything.
+func textAffinity(declared string) bool {
+	declared = strings.ToUpper(declared)
+	if declared == "" || strings.Contains(declared, "INT") {
+		return false
+	}
+	return strings.Contains(declared, "CHAR") || strings.Contains(declared, "CLOB") ||
+		strings.Contains(declared, "TEXT") || strings.Contains(declared, "BLOB")
+}
+
+// Returns true if a column name looks like it holds the given coordinate, such as avg_lon for
+// lon
+func looksLike(column, coordinate string) bool {
+	column = strings.ToLower(column)
+	other := "lat"
+	if coordinate == "lat" {
+		other = "lon"
+	}
+	return strings.Contains(column, coordinate) && !strings.Contains(column, other)
+}
+
+// Returns the names that are close to name, closest first. Names that only differ in case or
+// that contain each other are close, and so are names a few edits away.
+func suggestNames(name string, names []string) []string {
+	type suggestion struct {
+		name string
+		distance int
+	}
+
+	var (
+		suggestions []suggestion
+		lower = strings.ToLower(name)
+		maxDistance = len(name) / 4
+	)
+	if maxDistance < 2 {
+		maxDistance = 2
+	}
+
+	for _, v := range names {
+		candidate := strings.ToLower(v)
+		distance := levenshtein(lower, candidate)
+		if distance <= maxDistance || len(lower) >= 3 && (strings.Contains(candidate, lower) ||
+			strings.Contains(lower, candidate) && len(candidate) >= 3) {
+			suggestions = append(suggestions, suggestion{v, distance})
+		}
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool { return suggestions[i].distance < suggestions[j].distance })
+	if len(suggestions) > maxSuggestions {
+		suggestions = suggestions[:maxSuggestions]
+	}
+	// Names much further away than the closest one are only noise
+	for i, v := range suggestions {
+		if v.distance > suggestions[0].distance + 2 {
+			suggestions = suggestions[:i]
+			break
+		}
+	}
+
+	result := make([]string, len(suggestions))
+	for i, v := range suggestions {
+		result[i] = v.name
+	}
+	return result
+}
+
+// Returns " Did you mean a, b or c?" for the suggestions, or nothing if there are none
+func didYouMean(suggestions []string) string {
+	switch len(suggestions) {
+	case 0:
+		return ""
+	case 1:
+		return fmt.Sprintf(" Did you mean %s?", suggestions[0])
+	default:
+		last := len(suggestions) - 1
+		return fmt.Sprintf(" Did you mean %s or %s?", strings.Join(suggestions[:last], ", "), suggestions[last])
+	}
+}
+
+// Returns the number of single character insertions, deletions and substitutions that turn a
+// into b
+func levenshtein(a, b string) int {
+	first, second := []rune(a), []rune(b)
+	previous := make([]int, len(second) + 1)
+	current := make([]int, len(second) + 1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(first); i++ {
+		current[0] = i
+		for j := 1; j <= len(second); j++ {
+			cost := 1
+			if first[i - 1] == second[j - 1] {
+				cost = 0
+			}
+
+			current[j] = previous[j] + 1
+			if current[j - 1] + 1 < current[j] {
+				current[j] = current[j - 1] + 1
+			}
+			if previous[j - 1] + cost < current[j] {
+				current[j] = previous[j - 1] + cost
+			}
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(second)]
+}
@@ -0,0 +1,90 @@
+package kismetClient
+
+// A followCursor remembers how far a table has been read, so that reading it again only returns
+// the rows that were added or updated since. Tables that record single events are only ever
+// added to, so they are followed by rowid. Kismet replaces the row of a device whenever it is
+// seen again, which doesn't always give the row a new rowid, so devices are followed by the time
+// they were last seen. Times only have whole seconds, so the rows at the latest time are read
+// again and the ones that were already returned are skipped.
+type followCursor struct {
+	// True once a row has been read
+	started bool
+	// Follow the last seen time instead of the rowid
+	byTime bool
+	// The largest rowid or time read so far
+	position int64
+	// The rowids of the rows read at the latest time
+	seen map[int64]bool
+}
+
+// Returns the cursor columns to select, the condition that leaves out what was already read and
+// the order the rows must be read in for the cursor to move forward
+func (cursor *followCursor) query(table TableSchema) (string, string, []interface{}, string, error) {
+	quotedTable, err := quoteIdentifier(table.Name)
+	if err != nil {
+		return "", "", nil, "", err
+	}
+
+	rowid := quotedTable + ".rowid"
+	column := rowid
+	if table.LastTime != "" && table.LastTime != table.FirstTime {
+		quotedColumn, err := quoteIdentifier(table.LastTime)
+		if err != nil {
+			return "", "", nil, "", err
+		}
+		column = quotedTable + "." + quotedColumn
+		cursor.byTime = true
+	}
+
+	var (
+		where string
+		args []interface{}
+	)
+	if cursor.started {
+		if cursor.byTime {
+			where = column + " >= ?"
+		} else {
+			where = column + " > ?"
+		}
+		args = []interface{}{cursor.position}
+	}
+
+	return rowid + ", " + column, where, args, " order by " + column + ", " + rowid, nil
+}
+
+// Returns the value of the cursor column a row is followed by
+func (cursor *followCursor) value(rowid, position interface{}) (int64, int64) {
+	id, _ := rowid.(int64)
+	if !cursor.byTime {
+		return id, id
+	}
+
+	switch v := position.(type) {
+	case int64:
+		return id, v
+	case float64:
+		return id, int64(v)
+	}
+	return id, 0
+}
+
+// Returns false if the row, given the values of the cursor columns, was already read before
+func (cursor *followCursor) unread(rowid, position interface{}) bool {
+	id, value := cursor.value(rowid, position)
+	return !cursor.started || value != cursor.position || !cursor.seen[id]
+}
+
+// Moves the cursor past a row, given the values of the cursor columns. Only called once the row
+// has been returned, so that a row that failed is not skipped.
+func (cursor *followCursor) advance(rowid, position interface{}) {
+	id, value := cursor.value(rowid, position)
+
+	if !cursor.started || value > cursor.position {
+		cursor.started = true
+		cursor.position = value
+		cursor.seen = make(map[int64]bool)
+	}
+	if cursor.byTime {
+		cursor.seen[id] = true
+	}
+}
@@ -0,0 +1,321 @@
+package kismetClient
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How many device records are read to find the JSON fields of the devices table
+const inspectSampleSize = 100
+
+// A DBReport describes what is in a kismetdb. It is meant to help building -filter specs
+// without opening the database in another tool.
+type DBReport struct {
+	// The contents of the KISMET table of the database
+	KismetVersion string
+	DBVersion int
+
+	// Every table in the database, including ones this package doesn't know about
+	Tables []TableReport
+
+	// The earliest and latest times recorded in any table. Zero if nothing has a time.
+	FirstTime, LastTime time.Time
+
+	// How many packets and devices there are, and how many of them have a GPS fix
+	Packets, PacketsWithFix int64
+	Devices, DevicesWithFix int64
+
+	// The distinct PHYs of the devices and packets
+	Phys []string
+
+	// The fields found in the JSON records of the devices table, as column paths such as
+	// device:kismet.device.base.macaddr, with how many of the sampled records have them
+	DeviceFields []FieldReport
+	// How many device records were sampled
+	DeviceSamples int
+}
+
+type TableReport struct {
+	Name string
+	Rows int64
+	Columns []ColumnReport
+}
+
+type ColumnReport struct {
+	Name string
+	// The type SQLite declares for the column
+	Type string
+}
+
+type FieldReport struct {
+	Path string
+	Records int
+}
+
+// Reads the layout and a summary of the contents of a kismetdb
+func InspectDB(dbFile string) (DBReport, error) {
+	db, kismetVersion, dbVersion, schema, err := openKismetDB(dbFile)
+	if err != nil {
+		return DBReport{}, err
+	}
+	defer db.Close()
+
+	report := DBReport{KismetVersion: kismetVersion, DBVersion: dbVersion}
+
+	if report.Tables, err = inspectTables(db) ; err != nil {
+		return DBReport{}, err
+	}
+
+	has := make(map[string]bool)
+	for _, v := range report.Tables {
+		has[v.Name] = true
+	}
+
+	// Each of these only covers the tables that the database actually has
+	for _, name := range schema.TableNames() {
+		table := schema.Table(name)
+		if !has[name] || table.FirstTime == "" {
+			continue
+		}
+
+		first, last, err := timeRange(db, schema, table)
+		if err != nil {
+			return DBReport{}, err
+		}
+		if !first.IsZero() && (report.FirstTime.IsZero() || first.Before(report.FirstTime)) {
+			report.FirstTime = first
+		}
+		if last.After(report.LastTime) {
+			report.LastTime = last
+		}
+	}
+
+	if has["packets"] {
+		packets := schema.Table("packets")
+		if report.Packets, report.PacketsWithFix, err = fixCoverage(db, packets) ; err != nil {
+			return DBReport{}, err
+		}
+	}
+
+	if has["devices"] {
+		devices := schema.Table("devices")
+		if report.Devices, report.DevicesWithFix, err = fixCoverage(db, devices) ; err != nil {
+			return DBReport{}, err
+		}
+
+		if report.DeviceFields, report.DeviceSamples, err = sampleFields(db, devices) ; err != nil {
+			return DBReport{}, err
+		}
+	}
+
+	var phyTables []string
+	for _, v := range []string{"devices", "packets"} {
+		if has[v] {
+			phyTables = append(phyTables, v)
+		}
+	}
+	if report.Phys, err = distinctPhys(db, schema, phyTables) ; err != nil {
+		return DBReport{}, err
+	}
+
+	return report, nil
+}
+
+// Lists the tables of the database with their columns and row counts
+func inspectTables(db *sql.DB) ([]TableReport, error) {
+	var names []string
+
+	rows, err := db.Query("select name from sqlite_master where type = 'table' and name not like 'sqlite_%' order by name;")
+	if err != nil {
+		return nil, KismetDBError(fmt.Sprint("Failed to list the tables: ", err))
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name) ; err != nil {
+			rows.Close()
+			return nil, KismetDBError(fmt.Sprint("Failed to list the tables: ", err))
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err() ; err != nil {
+		return nil, KismetDBError(fmt.Sprint("Failed to list the tables: ", err))
+	}
+
+	tables := make([]TableReport, 0, len(names))
+	for _, name := range names {
+		quoted, err := quoteIdentifier(name)
+		if err != nil {
+			continue // Not a table anything in this program could read
+		}
+
+		table := TableReport{Name: name}
+		if err := db.QueryRow("select count(*) from " + quoted + ";").Scan(&table.Rows) ; err != nil {
+			return nil, KismetDBError(fmt.Sprint("Failed to count the rows of ", name, ": ", err))
+		}
+
+		if table.Columns, err = tableColumnReports(db, name) ; err != nil {
+			return nil, err
+		}
+
+		tables = append(tables, table)
+	}
+
+	return tables, nil
+}
+
+// Returns the earliest and latest times in a table. Kismet leaves the time 0 when it doesn't
+// know it, so those are left out.
+func timeRange(db *sql.DB, schema *KismetSchema, table TableSchema) (time.Time, time.Time, error) {
+	var first, last sql.NullInt64
+
+	quotedTable, _ := quoteIdentifier(table.Name)
+	firstColumn, _ := quoteIdentifier(table.FirstTime)
+	lastColumn, _ := quoteIdentifier(table.LastTime)
+
+	statement := fmt.Sprintf("select min(nullif(%s, 0)), max(%s) from %s;", firstColumn, lastColumn, quotedTable)
+	if err := db.QueryRow(statement).Scan(&first, &last) ; err != nil {
+		return time.Time{}, time.Time{}, KismetDBError(fmt.Sprint("Failed to read the times in ", table.Name, ": ", err))
+	}
+
+	var firstTime, lastTime time.Time
+	if first.Valid {
+		firstTime = schema.Timestamp(first.Int64, nil)
+	}
+	if last.Valid && last.Int64 != 0 {
+		lastTime = schema.Timestamp(last.Int64, nil)
+	}
+	return firstTime, lastTime, nil
+}
+
+// Counts the rows of a table and how many of them have a GPS fix
+func fixCoverage(db *sql.DB, table TableSchema) (int64, int64, error) {
+	var total, withFix int64
+
+	quotedTable, _ := quoteIdentifier(table.Name)
+	statement := fmt.Sprintf("select count(*), count(case when %s then 1 end) from %s;", gpsFixCondition(table), quotedTable)
+	if err := db.QueryRow(statement).Scan(&total, &withFix) ; err != nil {
+		return 0, 0, KismetDBError(fmt.Sprint("Failed to count the GPS fixes in ", table.Name, ": ", err))
+	}
+
+	return total, withFix, nil
+}
+
+// Returns the distinct PHYs of the tables
+func distinctPhys(db *sql.DB, schema *KismetSchema, tables []string) ([]string, error) {
+	if len(tables) == 0 {
+		return nil, nil
+	}
+
+	selects := make([]string, len(tables))
+	for i, v := range tables {
+		table := schema.Table(v)
+		quotedTable, _ := quoteIdentifier(table.Name)
+		phy, _ := quoteIdentifier(table.Phy)
+		selects[i] = "select " + phy + " from " + quotedTable
+	}
+
+	rows, err := db.Query(strings.Join(selects, " union ") + ";")
+	if err != nil {
+		return nil, KismetDBError(fmt.Sprint("Failed to read the PHYs: ", err))
+	}
+	defer rows.Close()
+
+	var phys []string
+	for rows.Next() {
+		var phy sql.NullString
+		if err := rows.Scan(&phy) ; err != nil {
+			return nil, KismetDBError(fmt.Sprint("Failed to read the PHYs: ", err))
+		}
+		if phy.Valid && phy.String != "" {
+			phys = append(phys, phy.String)
+		}
+	}
+
+	return phys, rows.Err()
+}
+
+// Finds the JSON fields in a sample of the device records. Kismet keys some records by MAC
+// address or number instead of by field name. Those records are reported as a single field, as
+// their keys are different for every device.
+func sampleFields(db *sql.DB, table TableSchema) ([]FieldReport, int, error) {
+	quotedTable, _ := quoteIdentifier(table.Name)
+	column, _ := quoteIdentifier(table.JSON)
+
+	rows, err := db.Query(fmt.Sprintf("select %s from %s limit %d;", column, quotedTable, inspectSampleSize))
+	if err != nil {
+		return nil, 0, KismetDBError(fmt.Sprint("Failed to read the device records: ", err))
+	}
+	defer rows.Close()
+
+	var (
+		counts = make(map[string]int)
+		samples = 0
+	)
+
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw) ; err != nil {
+			return nil, 0, KismetDBError(fmt.Sprint("Failed to read the device records: ", err))
+		}
+
+		record, err := decodeJSONRecord(Blob(raw))
+		if err != nil || record == nil {
+			continue // Inspecting is for finding what can be read, not for validating
+		}
+		samples++
+
+		found := make(map[string]bool)
+		collectFields(record, table.JSON + ":", found)
+		for path := range found {
+			counts[path]++
+		}
+	}
+	if err := rows.Err() ; err != nil {
+		return nil, 0, KismetDBError(fmt.Sprint("Failed to read the device records: ", err))
+	}
+
+	fields := make([]FieldReport, 0, len(counts))
+	for path, records := range counts {
+		fields = append(fields, FieldReport{path, records})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Path < fields[j].Path })
+
+	return fields, samples, nil
+}
+
+// Adds the path of every field below the record to found
+func collectFields(record interface{}, prefix string, found map[string]bool) {
+	fields, ok := record.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	for key := range fields {
+		if !isFieldName(key) {
+			// Keyed by MAC address or number. Report the record itself instead
+			found[strings.TrimSuffix(strings.TrimSuffix(prefix, "/"), ":")] = true
+			return
+		}
+	}
+
+	for key, value := range fields {
+		path := prefix + key
+		if _, isRecord := value.(map[string]interface{}) ; isRecord {
+			collectFields(value, path + "/", found)
+		} else {
+			found[path] = true
+		}
+	}
+}
+
+// Kismet field names look like kismet.device.base.macaddr
+func isFieldName(key string) bool {
+	if key == "" || !(key[0] >= 'a' && key[0] <= 'z' || key[0] >= 'A' && key[0] <= 'Z') {
+		return false
+	}
+	return strings.Contains(key, ".") && !strings.Contains(key, ":")
+}
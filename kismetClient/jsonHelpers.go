@@ -0,0 +1,94 @@
+package kismetClient
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Kismet field paths use the same syntax everywhere. Fields of nested records are separated
+// by slashes, such as dot11.device/dot11.device.last_beaconed_ssid, and elements of arrays
+// are picked by their index.
+func splitFieldPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// Decodes a Kismet JSON record. Numbers are kept as json.Number so that large integers such
+// as device keys survive.
+func decodeJSONRecord(value interface{}) (interface{}, error) {
+	var (
+		raw    []byte
+		record interface{}
+	)
+
+	switch v := value.(type) {
+	case Blob:
+		raw = v
+	case []byte:
+		raw = v
+	case string:
+		raw = []byte(v)
+	default:
+		return nil, nil
+	}
+
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&record); err != nil {
+		return nil, KismetDBError("Failed to decode JSON record: " + err.Error())
+	}
+
+	return record, nil
+}
+
+// Walks a decoded JSON record along the path and returns what is found there as a plain Go
+// value. Fields that are missing come back as nil.
+func fieldAt(record interface{}, path []string) interface{} {
+	current := record
+	for _, v := range path {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			current = node[v]
+		case []interface{}:
+			if index, err := strconv.Atoi(v); err == nil && index >= 0 && index < len(node) {
+				current = node[index]
+			} else {
+				return nil
+			}
+		default:
+			return nil
+		}
+	}
+
+	return jsonValue(current)
+}
+
+// Converts a decoded JSON value into the types the rest of the package uses. Integers become
+// int64 and other numbers float64. Records and arrays are kept as compact JSON text.
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case map[string]interface{}, []interface{}:
+		if encoded, err := json.Marshal(v); err == nil {
+			return string(encoded)
+		}
+		return nil
+	default:
+		return v
+	}
+}
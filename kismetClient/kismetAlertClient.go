@@ -0,0 +1,194 @@
+package kismetClient
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// The KismetAlertClient reads the alerts table of a kismetdb. Kismet raises alerts for things
+// such as deauthentication floods and spoofed access points. Each alert becomes one element,
+// located where Kismet was when the alert was raised.
+type KismetAlertClient struct {
+	tableClient
+}
+
+// The columns of an alert element. The DB and REST clients produce the same columns.
+var alertHeaders = []string{
+	"lat", "lon", "devmac", "timestamp", "header", "class", "severity", "text", "other_mac", "phyname",
+}
+
+// The parts of an alert record that don't have columns of their own in the alerts table
+type alertRecord struct {
+	Class    interface{}
+	Severity interface{}
+	Text     interface{}
+	OtherMAC interface{}
+}
+
+// Reads the fields of a Kismet alert record. The record is the same whether it came from the
+// json column of the alerts table or from the REST API.
+func decodeAlertRecord(record interface{}) alertRecord {
+	return alertRecord{
+		fieldAt(record, []string{"kismet.alert.class"}),
+		fieldAt(record, []string{"kismet.alert.severity"}),
+		fieldAt(record, []string{"kismet.alert.text"}),
+		fieldAt(record, []string{"kismet.alert.other_mac"}),
+	}
+}
+
+// Returns a generator of the alerts in the database that match the filter
+func (client *KismetAlertClient) Elements() (func() (DataElement, error), error) {
+	badFunc := func() (DataElement, error) { return DataElement{}, KismetDBError("Generator not Initialized") }
+
+	if !client.Ready {
+		return badFunc, KismetDBError("DB Client is not ready!")
+	}
+
+	table := client.Schema.Table("alerts")
+	client.query = &tableQuery{
+		db: client.db,
+		schema: client.Schema,
+		table: table,
+		columns: []string{
+			table.Lat, table.Lon, table.MAC, table.FirstTime, table.SubTime, table.Type, table.Phy, table.JSON,
+		},
+		filter: client.Filter,
+	}
+
+	if err := client.query.run() ; err != nil {
+		return badFunc, err
+	}
+
+	return func() (DataElement, error) {
+		row, err := client.query.next()
+		if err != nil || row == nil {
+			return DataElement{}, err
+		}
+
+		record, err := decodeJSONRecord(row[table.JSON])
+		if err != nil {
+			return DataElement{}, err
+		}
+		alert := decodeAlertRecord(record)
+
+		return DataElement{
+			ID: row.string(table.MAC),
+			Lat: row.coordinate(client.Schema, table.Lat),
+			Lon: row.coordinate(client.Schema, table.Lon),
+			data: []interface{}{
+				client.Schema.Timestamp(row[table.FirstTime], row[table.SubTime]),
+				row[table.Type],
+				alert.Class,
+				alert.Severity,
+				alert.Text,
+				alert.OtherMAC,
+				row[table.Phy],
+			},
+			extraData: true,
+			HasData: true,
+		}, nil
+	}, nil
+}
+
+func (client *KismetAlertClient) ElementHeaders() []string {
+	return alertHeaders
+}
+
+// Returns a client for the alerts table of the database. The client requires the Finish() call
+// to disconnect from the database when users are finished with it.
+func NewAlertClient(dbFile string) (KismetAlertClient, error) {
+	table, err := openTableClient(dbFile)
+	if err != nil {
+		return KismetAlertClient{}, err
+	}
+
+	return KismetAlertClient{tableClient: table}, nil
+}
+
+// The KismetRestAlertClient reads the alerts a live Kismet server is holding through its REST API.
+// It uses the authentication of an existing KismetRestClient.
+type KismetRestAlertClient struct {
+	client *KismetRestClient
+}
+
+// Returns a client for the alerts of the Kismet server that the rest client is connected to
+func NewRestAlertClient(client *KismetRestClient) KismetRestAlertClient {
+	return KismetRestAlertClient{client}
+}
+
+// Returns a generator of the alerts held by the Kismet server
+func (alertClient *KismetRestAlertClient) Elements() (func() (DataElement, error), error) {
+	return alertClient.ElementsContext(context.Background())
+}
+
+// Like Elements(), with the request cancelled when ctx is
+func (alertClient *KismetRestAlertClient) ElementsContext(ctx context.Context) (func() (DataElement, error), error) {
+	var (
+		alerts []interface{}
+		badFunc = func() (DataElement, error) { return DataElement{}, KismetRestError("Failed to create generator") }
+	)
+
+	if !alertClient.client.Ready || alertClient.client.finished() {
+		return badFunc, KismetRestError("Client is not ready")
+	}
+
+	if err := alertClient.client.getJSON(ctx, alertsPath, &alerts) ; err != nil {
+		return badFunc, err
+	}
+
+	offset := 0
+	return func() (DataElement, error) {
+		if offset >= len(alerts) { // No more alerts left
+			return DataElement{}, nil
+		}
+
+		record := alerts[offset]
+		offset++
+
+		alert := decodeAlertRecord(record)
+		element := DataElement{
+			data: []interface{}{
+				alertTime(fieldAt(record, []string{"kismet.alert.timestamp"})),
+				fieldAt(record, []string{"kismet.alert.header"}),
+				alert.Class,
+				alert.Severity,
+				alert.Text,
+				alert.OtherMAC,
+				// The REST API only has the number Kismet gave the PHY, not its name
+				fieldAt(record, []string{"kismet.alert.phy_id"}),
+			},
+			extraData: true,
+			HasData: true,
+		}
+
+		if mac, ok := fieldAt(record, []string{"kismet.alert.transmitter_mac"}).(string) ; ok {
+			element.ID = mac
+		}
+
+		// Newer versions of Kismet only report the location as a [lon, lat] geopoint
+		location := []string{"kismet.alert.location"}
+		if lat, ok := numberValue(fieldAt(record, append(location, "kismet.common.location.lat"))) ; ok && lat != 0 {
+			element.Lat = lat
+			element.Lon, _ = numberValue(fieldAt(record, append(location, "kismet.common.location.lon")))
+		} else {
+			element.Lon, _ = numberValue(fieldAt(record, append(location, "kismet.common.location.geopoint", "0")))
+			element.Lat, _ = numberValue(fieldAt(record, append(location, "kismet.common.location.geopoint", "1")))
+		}
+
+		return element, nil
+	}, nil
+}
+
+func (alertClient *KismetRestAlertClient) ElementHeaders() []string {
+	return alertHeaders
+}
+
+// The REST API reports alert times as fractional seconds
+func alertTime(value interface{}) interface{} {
+	if seconds, ok := numberValue(value) ; ok && value != nil {
+		whole, fraction := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(fraction * 1e9)).UTC()
+	}
+	return value
+}
@@ -4,7 +4,6 @@ import (
 	"database/sql"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3" // Needed as sqlite3 driver for database/sql
-	"os"
 	"strings"
 )
 
@@ -14,8 +13,34 @@ type KismetDBClient struct {
 
 	Table string
 	Columns []string
+	// Restricts the rows that are read. Set before calling Elements()
+	Filter QueryFilter
+	// Add what the other tables recorded about each device after the columns (see enrichHeaders).
+	// Only for the devices table. Set before calling Elements()
+	Enrich bool
+	// Only return the rows added or updated since the previous call of Elements() after the first
+	// one (see followCursor). Set before calling Elements()
+	Follow bool
+	// Read the table in rowid ranges with this many connections at once (see parallelElements).
+	// 0 and 1 read it with a single query, and so does following or enriching, as every range
+	// would aggregate the packets and data tables again. Set before calling Elements()
+	Workers int
+	// Return the rows in the order of their rowid when reading with several workers. Set before
+	// calling Elements()
+	Ordered bool
+
+	// The contents of the KISMET table of the database
+	KismetVersion string
+	DBVersion int
+	// How this version of the database stores its data
+	Schema *KismetSchema
 
 	Ready bool
+
+	columnTypes []string
+	cursor followCursor
+	// Closed by Finish() to stop the workers of parallelElements
+	stop chan struct{}
 }
 
 // When calling Elements(), the DB Client automatically runs the prepared query
@@ -25,93 +50,73 @@ type KismetDBClient struct {
 // is running a devices query on a Kismet DB, this would return unique elements
 // for each device in the Kismet DB
 func (client *KismetDBClient) Elements() (func() (DataElement, error), error) {
-	numFilters := len(client.Columns)
-	rowContent := make([]interface{}, numFilters)
+	numFilters := len(client.ElementHeaders())
+	// Following reads the cursor columns after the selected columns
+	numCursor := 0
+	if client.Follow {
+		numCursor = 2
+	}
+	rowContent := make([]interface{}, numFilters + numCursor)
 
 	badFunc := func () (DataElement, error) { return DataElement{}, KismetDBError("Generator not Initialized") }
 
+	decoder := client.newRowDecoder()
+
+	if client.Workers > 1 && !client.Follow && !client.Enrich {
+		return client.parallelElements(decoder)
+	}
+
 	if err := client.runQuery() ; err == nil {
 		if columnTypes, err := client.rows.ColumnTypes(); err == nil {
+			client.columnTypes = make([]string, numFilters)
 			for i, v := range columnTypes {
-				theType := v.DatabaseTypeName()
-				switch theType {
-				case "TEXT":
-					var newVal string
-					rowContent[i] = &newVal
-				case "INT":
-					var newVal int
-					rowContent[i] = &newVal
-				default:
-					return badFunc, KismetDBError("Unhandled DB Type from database query. Please only use INT and TEXT columns")
+				rowContent[i] = scanTarget()
+				if i >= numFilters {
+					continue
+				}
+
+				client.columnTypes[i] = v.DatabaseTypeName()
+				if decoder.paths[i] != nil {
+					client.columnTypes[i] = "JSON"
 				}
 			}
+		} else {
+			return badFunc, KismetDBError(fmt.Sprint("Failed to read column types: ", err))
 		}
 
 		return func() (DataElement, error) {
-			returnElement := DataElement{}
-
-			if client.rows.Next() {
+			for client.rows.Next() {
 				// Returns elements one row at a time
 				if err := client.rows.Scan(rowContent...) ; err != nil {
-					return returnElement, KismetDBError("Failed to parse database!")
+					return DataElement{}, KismetDBError(fmt.Sprint("Failed to parse database: ", err))
 				}
 
-				for i := 0 ; i < 2 ; i++ {
-					switch rowContent[i].(type) {
-					case *int:
-					default:
-						return returnElement, KismetDBError("Lat or Lon field not an int!")
-					}
+				if !client.Follow {
+					return decoder.decode(rowContent[:numFilters])
 				}
 
-				returnElement.Lat = float64(*rowContent[0].(*int)) / 100000
-				returnElement.Lon = float64(*rowContent[1].(*int)) / 100000
-
-				switch rowContent[2].(type) {
-				case *string:
-					returnElement.ID = *rowContent[2].(*string)
-				case *int:
-					returnElement.ID = string(*rowContent[2].(*int))
-				default:
-					return returnElement, KismetDBError("ID data from kismet not proper")
+				rowid, position := scannedValue(rowContent[numFilters]), scannedValue(rowContent[numFilters + 1])
+				if !client.cursor.unread(rowid, position) {
+					continue // Already returned by the previous call
 				}
 
-				returnElement.HasData = true
-
-				var extraData []interface{}
-
-				// Check for extra data that will go into the extra data []interface{}
-				if numData := len(rowContent) ; numData > 3 {
-					returnElement.extraData = true
-					extraData = make([]interface{}, numData - 3)
-
-					// This is significantly more complicated than its REST alternative because we get pointer data
-					// from the DB call rather than un-referenced data. This means that we have to save it now or
-					// loose it forever down the line.
-					for n, v := range rowContent[3:] {
-						switch v.(type) { // Test type
-						case *string: // Match type
-							extraData[n] = *(v.(*string))
-						case *int:
-							extraData[n] = *(v.(*int))
-						case *int64:
-							extraData[n] = *(v.(*int64))
-						case *bool:
-							extraData[n] = *(v.(*bool))
-						default:
-							returnElement.HasData = false
-							return returnElement, KismetDBError("Unhandled type in extra data fields")
-						}
-					}
-				} else {
-					returnElement.extraData = false // Be explicit
-					extraData = nil
+				element, err := decoder.decode(rowContent[:numFilters])
+				if err != nil {
+					// The row would fail the same way every time it is read again
+					return element, KismetRowError(fmt.Sprintf("Row %v of %s can't be read: %v", rowid,
+						client.Table, err))
 				}
-				returnElement.data = extraData
 
-				return returnElement, nil
+				client.cursor.advance(rowid, position)
+				return element, nil
+			}
+
+			// Next() also returns false when iterating failed part way through. Make sure that
+			// doesn't look like the end of the data.
+			if err := client.rows.Err() ; err != nil {
+				return DataElement{}, KismetDBError(fmt.Sprint("Failed to read from database: ", err))
 			}
-			return returnElement, KismetDBError("No more rows left")
+			return DataElement{}, nil // No more rows left
 		}, nil
 	} else {
 		return badFunc, KismetDBError(
@@ -119,52 +124,215 @@ func (client *KismetDBClient) Elements() (func() (DataElement, error), error) {
 	}
 }
 
+// A rowDecoder turns the scanned columns of a row into an element. It only reads its own
+// fields, so several goroutines can decode rows with the same decoder.
+type rowDecoder struct {
+	schema *KismetSchema
+	columns []string
+	// How each column is decoded. Columns may point into the JSON record of a column, and
+	// the first two columns (latitude and longitude) are always coordinates.
+	names []string
+	paths [][]string
+	coordinates []bool
+}
+
+func (client *KismetDBClient) newRowDecoder() *rowDecoder {
+	numFilters := len(client.ElementHeaders())
+	table := client.Schema.Table(client.Table)
+
+	decoder := &rowDecoder{
+		schema: client.Schema,
+		columns: client.Columns,
+		names: make([]string, numFilters),
+		paths: make([][]string, numFilters),
+		coordinates: make([]bool, numFilters),
+	}
+	for i, v := range client.Columns {
+		decoder.names[i], decoder.paths[i] = splitDBColumn(v)
+		decoder.coordinates[i] = decoder.paths[i] == nil && (i < 2 || table.IsCoordinate(decoder.names[i]))
+	}
+	if client.Enrich {
+		for i, v := range enrichHeaders {
+			decoder.names[len(client.Columns) + i] = v
+			decoder.coordinates[len(client.Columns) + i] = isEnrichCoordinate(v)
+		}
+	}
+
+	return decoder
+}
+
+// Decodes the scan targets of the selected columns of a row
+func (decoder *rowDecoder) decode(rowContent []interface{}) (DataElement, error) {
+	returnElement := DataElement{}
+
+	// This is significantly more complicated than its REST alternative because we get pointer data
+	// from the DB call rather than un-referenced data. This means that we have to save it now or
+	// loose it forever down the line.
+	values := make([]interface{}, len(rowContent))
+	records := make(map[string]interface{}) // Each JSON record is only decoded once per row
+	for i, v := range rowContent {
+		values[i] = scannedValue(v)
+
+		if decoder.paths[i] != nil {
+			record, decoded := records[decoder.names[i]]
+			if !decoded {
+				var err error
+				if record, err = decodeJSONRecord(values[i]) ; err != nil {
+					return returnElement, KismetDBError(fmt.Sprintf("Column %s: %v", decoder.names[i], err))
+				}
+				records[decoder.names[i]] = record
+			}
+			values[i] = fieldAt(record, decoder.paths[i])
+		} else if decoder.coordinates[i] {
+			// Coordinates are decoded the same way no matter where they are
+			if decoded, err := decoder.schema.Coordinate(values[i]) ; err == nil && values[i] != nil {
+				values[i] = decoded
+			} else if err != nil && i < 2 {
+				return returnElement, KismetDBError(fmt.Sprintf("Bad coordinate in %s: %v", decoder.names[i], err))
+			}
+		}
+	}
+
+	if lat, ok := numberValue(values[0]) ; ok {
+		returnElement.Lat = lat
+	} else {
+		return returnElement, KismetDBError(fmt.Sprintf("Bad latitude in %s: %v", decoder.columns[0], values[0]))
+	}
+
+	if lon, ok := numberValue(values[1]) ; ok {
+		returnElement.Lon = lon
+	} else {
+		return returnElement, KismetDBError(fmt.Sprintf("Bad longitude in %s: %v", decoder.columns[1], values[1]))
+	}
+
+	if values[2] != nil {
+		returnElement.ID = fmt.Sprint(values[2])
+	}
+
+	returnElement.HasData = true
+
+	// Check for extra data that will go into the extra data []interface{}
+	if len(values) > 3 {
+		returnElement.extraData = true
+		returnElement.data = values[3:]
+	} else {
+		returnElement.extraData = false // Be explicit
+		returnElement.data = nil
+	}
+
+	return returnElement, nil
+}
+
 func (client *KismetDBClient) runQuery() error {
 	if !client.Ready {
 		return KismetDBError("DB Client is not read!")
 	}
+
+	// Following runs the query again, which may be after reading stopped part way through
+	if client.rows != nil {
+		client.rows.Close()
+	}
+
+	// When following, where the cursor has got to is read after the selected columns
+	var (
+		cursorColumns, cursorWhere, order string
+		cursorArgs []interface{}
+	)
+	if client.Follow {
+		var err error
+		if cursorColumns, cursorWhere, cursorArgs, order, err = client.cursor.query(client.Schema.Table(client.Table)) ; err != nil {
+			return err
+		}
+	}
+
+	query, args, err := client.buildQuery(cursorColumns, cursorWhere, cursorArgs, order)
+	if err != nil {
+		return err
+	}
+
+	if rows, err := client.db.Query(query, args...) ; err == nil {
+		client.rows = rows
+		return nil
+	} else {
+		return KismetDBError(fmt.Sprint("DB Query failed: ", err))
+	}
+}
+
+// Builds the query for the columns and rows of the client. extraColumns are selected after the
+// columns, condition is combined with the filter using and, and order is appended to the query.
+func (client *KismetDBClient) buildQuery(extraColumns, condition string, conditionArgs []interface{}, order string) (string, []interface{}, error) {
 	var query strings.Builder
 
 	columnLen := len(client.Columns)
 	query.WriteString("select ")
 	if columnLen == 0 {
 		client.Ready = false
-		return KismetDBError("No Columns to select from the table")
+		return "", nil, KismetDBError("No Columns to select from the table")
 	} else {
 		for i, column := range client.Columns {
+			column, _ = splitDBColumn(column)
+			quoted, err := quoteIdentifier(column)
+			if err != nil {
+				return "", nil, err
+			}
+
 			if i == columnLen - 1 {
-				query.WriteString(fmt.Sprintf("%s ", column))
+				query.WriteString(fmt.Sprintf("%s ", quoted))
 			} else {
-				query.WriteString(fmt.Sprintf("%s, ", column))
+				query.WriteString(fmt.Sprintf("%s, ", quoted))
 			}
 		}
 	}
-	query.WriteString("from " + client.Table + ";")
 
-	if rows, err := client.db.Query(query.String()) ; err == nil {
-		client.rows = rows
-		return nil
+	table := client.Schema.Table(client.Table)
+
+	if extraColumns != "" {
+		extraColumns = ", " + extraColumns + " "
+	}
+
+	if quoted, err := quoteIdentifier(table.Name) ; err != nil {
+		return "", nil, err
+	} else if client.Enrich {
+		if table.Name != "devices" {
+			return "", nil, KismetDBError("Only the devices table can be enriched")
+		}
+
+		selectList, joins, err := enrichDevices(client.Schema)
+		if err != nil {
+			return "", nil, err
+		}
+		query.WriteString(", " + selectList + extraColumns + " from " + quoted + joins)
 	} else {
-		return KismetDBError(fmt.Sprint("DB Query failed: ", err))
+		query.WriteString(extraColumns + "from " + quoted)
 	}
+
+	where, args, err := client.Filter.where(table, client.Schema)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if condition != "" {
+		if where == "" {
+			where = " where " + condition
+		} else {
+			where += " and " + condition
+		}
+		args = append(args, conditionArgs...)
+	}
+	query.WriteString(where + order + ";")
+
+	return query.String(), args, nil
 }
 
 // This function returns a fully initialized and ready to run Kismet DB client.
 // The client is connected to the database and requires the Finish() call to
 // clean up and disconnect from the database when users are finished with it.
+// The database is only ever read, so it is safe to use on files Kismet is still
+// writing to (see kismetDSN).
 func NewDBClient(dbFile, table string, columns []string) (KismetDBClient, error) {
-	var (
-		db *sql.DB
-	)
-
-	if _, err := os.Stat(dbFile) ; os.IsExist(err) {
-		return KismetDBClient{}, KismetDBError(fmt.Sprintf("%s does not exist!", dbFile))
-	}
-
-	if newDB, err := sql.Open("sqlite3", dbFile) ; err == nil {
-		db = newDB
-	} else {
-		return KismetDBClient{}, KismetDBError(fmt.Sprint("Failed to create DB connection", err))
+	db, kismetVersion, dbVersion, schema, err := openKismetDB(dbFile)
+	if err != nil {
+		return KismetDBClient{}, err
 	}
 
 	return KismetDBClient{
@@ -172,10 +340,30 @@ func NewDBClient(dbFile, table string, columns []string) (KismetDBClient, error)
 		nil,
 		table,
 		columns,
+		QueryFilter{},
+		false,
+		false,
+		0,
+		false,
+		kismetVersion,
+		dbVersion,
+		schema,
 		true,
+		nil,
+		followCursor{},
+		nil,
 	}, nil
 }
 
 func (client *KismetDBClient) ElementHeaders() []string {
+	if client.Enrich {
+		return append(append([]string{}, client.Columns...), enrichHeaders...)
+	}
 	return client.Columns
 }
+
+// Returns the SQLite types that the database declares for each column. Only available
+// after Elements() has been called.
+func (client *KismetDBClient) ColumnTypes() []string {
+	return client.columnTypes
+}
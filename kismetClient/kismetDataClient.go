@@ -0,0 +1,275 @@
+package kismetClient
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// The kinds of records in the data table that are decoded into their own columns
+const (
+	// Weather stations and other sensors heard by rtl_433
+	SensorRTL433 = "rtl433"
+	// Aircraft heard by an ADS-B receiver
+	SensorADSB = "adsb"
+	// Utility meters heard by rtlamr
+	SensorAMR = "amr"
+)
+
+// The KismetDataClient reads the data table of a kismetdb, where Kismet logs what its SDR
+// datasources hear: rtl_433 sensors, ADS-B aircraft and AMR utility meters. Each kind of record
+// is JSON of its own, so the fields that matter are decoded into columns that are shared by all
+// of them and left empty when a record doesn't have them. Whatever else the record holds is kept
+// as JSON in the readings column, so nothing is lost.
+type KismetDataClient struct {
+	tableClient
+}
+
+var dataHeaders = []string{
+	"lat", "lon", "devmac", "timestamp", "type", "datasource", "model", "sensor_id", "icao", "callsign",
+	"altitude_ft", "heading", "speed_kt", "meter_id", "meter_type", "consumption", "readings",
+}
+
+// A SensorRecord is a record from the data table, decoded according to its kind. Fields the
+// record doesn't have are nil.
+type SensorRecord struct {
+	Timestamp time.Time
+	// The MAC address Kismet made up for the sensor, aircraft or meter
+	DevMAC string
+	Phy string
+	Type string
+	// The UUID of the datasource that heard the record
+	Datasource string
+	// One of the Sensor constants, or empty if the kind of record isn't known
+	Kind string
+
+	// Where the record was heard. Aircraft report their own position, which is used instead
+	// when they do and makes HasReportedPosition true.
+	Lat, Lon float64
+	HasReportedPosition bool
+
+	// rtl_433 sensors
+	Model interface{}
+	SensorID interface{}
+
+	// ADS-B aircraft. The altitude is in feet and the speed in knots, like ADS-B reports them
+	ICAO interface{}
+	Callsign interface{}
+	Altitude interface{}
+	Heading interface{}
+	Speed interface{}
+
+	// AMR meters
+	MeterID interface{}
+	MeterType interface{}
+	Consumption interface{}
+
+	// The rest of the record as compact JSON text
+	Readings interface{}
+}
+
+// Returns a generator of the records in the data table that match the filter, in the order they
+// were heard. The generator returns a nil record once there are no more records.
+func (client *KismetDataClient) Records() (func() (*SensorRecord, error), error) {
+	badFunc := func() (*SensorRecord, error) { return nil, KismetDBError("Generator not Initialized") }
+
+	if !client.Ready {
+		return badFunc, KismetDBError("DB Client is not ready!")
+	}
+
+	table := client.Schema.Table("data")
+	client.query = &tableQuery{
+		db: client.db,
+		schema: client.Schema,
+		table: table,
+		columns: []string{
+			table.Lat, table.Lon, table.MAC, table.FirstTime, table.SubTime, table.Phy, table.Type,
+			table.Datasource, table.JSON,
+		},
+		filter: client.Filter,
+		suffix: timeOrder(table),
+	}
+
+	if err := client.query.run() ; err != nil {
+		return badFunc, err
+	}
+
+	return func() (*SensorRecord, error) {
+		row, err := client.query.next()
+		if err != nil || row == nil {
+			return nil, err
+		}
+
+		record := &SensorRecord{
+			Timestamp: client.Schema.Timestamp(row[table.FirstTime], row[table.SubTime]),
+			DevMAC: row.string(table.MAC),
+			Phy: row.string(table.Phy),
+			Type: row.string(table.Type),
+			Datasource: row.string(table.Datasource),
+			Lat: row.coordinate(client.Schema, table.Lat),
+			Lon: row.coordinate(client.Schema, table.Lon),
+		}
+		record.Kind = sensorKind(record.Type, record.Phy)
+
+		decoded, err := decodeJSONRecord(row[table.JSON])
+		if err != nil {
+			// Keep what Kismet logged rather than losing the record
+			record.Readings = row.string(table.JSON)
+			return record, nil
+		}
+
+		fields, isRecord := decoded.(map[string]interface{})
+		if !isRecord {
+			record.Readings = jsonValue(decoded)
+			return record, nil
+		}
+
+		switch record.Kind {
+		case SensorRTL433:
+			decodeRTL433(record, fields)
+		case SensorADSB:
+			decodeADSB(record, fields)
+		case SensorAMR:
+			decodeAMR(record, fields)
+		}
+		record.Readings = remainingFields(fields)
+
+		return record, nil
+	}, nil
+}
+
+// Works out the kind of a record from its type, or the PHY of the datasource that heard it
+func sensorKind(recordType, phy string) string {
+	for _, v := range []string{recordType, phy} {
+		v = strings.ToUpper(v)
+		switch {
+		case strings.Contains(v, "433"):
+			return SensorRTL433
+		case strings.Contains(v, "ADSB"):
+			return SensorADSB
+		case strings.Contains(v, "AMR"):
+			return SensorAMR
+		}
+	}
+	return ""
+}
+
+// rtl_433 records name the model of the sensor and its ID, next to the readings
+func decodeRTL433(record *SensorRecord, fields map[string]interface{}) {
+	takeField(fields, "time") // The same as the time of the row
+	record.Model = takeField(fields, "model")
+	record.SensorID = takeField(fields, "id")
+}
+
+// ADS-B records are keyed by the ICAO address of the aircraft. Different receivers name the
+// fields differently, so the common names are all tried.
+func decodeADSB(record *SensorRecord, fields map[string]interface{}) {
+	record.ICAO = takeField(fields, "icao", "icao24", "hex", "addr")
+	if icao, ok := record.ICAO.(string); ok {
+		record.ICAO = strings.ToUpper(icao) // Receivers disagree on the case of the hex digits
+	}
+	if callsign, ok := takeField(fields, "callsign", "flight").(string); ok {
+		record.Callsign = strings.TrimSpace(callsign)
+	}
+	record.Altitude = takeField(fields, "altitude", "alt_baro", "alt_geom", "alt")
+	record.Heading = takeField(fields, "heading", "track")
+	record.Speed = takeField(fields, "speed", "gs", "groundspeed")
+
+	lat, latOk := numberValue(takeField(fields, "lat", "latitude"))
+	lon, lonOk := numberValue(takeField(fields, "lon", "longitude"))
+	if latOk && lonOk && (lat != 0 || lon != 0) {
+		record.Lat, record.Lon = lat, lon
+		record.HasReportedPosition = true
+	}
+}
+
+// rtlamr records wrap the message of the meter, whose fields depend on the type of message
+func decodeAMR(record *SensorRecord, fields map[string]interface{}) {
+	takeField(fields, "time") // The same as the time of the row
+	takeField(fields, "offset")
+	takeField(fields, "length")
+	record.MeterType = takeField(fields, "type")
+
+	for key, value := range fields {
+		if message, isRecord := value.(map[string]interface{}); isRecord && strings.EqualFold(key, "message") {
+			record.MeterID = takeField(message, "id", "endpointid", "ertserialnumber")
+			record.Consumption = takeField(message, "consumption", "lastconsumptioncount", "lastconsumption")
+			if len(message) == 0 {
+				delete(fields, key)
+			}
+			return
+		}
+	}
+}
+
+// Removes the first of the named fields the record has and returns its value. Names are matched
+// without regard to case, as each decoder capitalizes them its own way.
+func takeField(fields map[string]interface{}, names ...string) interface{} {
+	for _, name := range names {
+		for key, value := range fields {
+			if strings.EqualFold(key, name) {
+				delete(fields, key)
+				return jsonValue(value)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the fields that weren't decoded into columns as compact JSON text, or nil if there are
+// none
+func remainingFields(fields map[string]interface{}) interface{} {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	if encoded, err := json.Marshal(fields); err == nil {
+		return string(encoded)
+	}
+	return nil
+}
+
+// Returns a generator of the records in the data table that match the filter
+func (client *KismetDataClient) Elements() (func() (DataElement, error), error) {
+	badFunc := func() (DataElement, error) { return DataElement{}, KismetDBError("Generator not Initialized") }
+
+	records, err := client.Records()
+	if err != nil {
+		return badFunc, err
+	}
+
+	return func() (DataElement, error) {
+		record, err := records()
+		if err != nil || record == nil {
+			return DataElement{}, err
+		}
+
+		return DataElement{
+			ID: record.DevMAC,
+			Lat: record.Lat,
+			Lon: record.Lon,
+			data: []interface{}{
+				record.Timestamp, record.Type, record.Datasource, record.Model, record.SensorID, record.ICAO,
+				record.Callsign, record.Altitude, record.Heading, record.Speed, record.MeterID,
+				record.MeterType, record.Consumption, record.Readings,
+			},
+			extraData: true,
+			HasData: true,
+		}, nil
+	}, nil
+}
+
+func (client *KismetDataClient) ElementHeaders() []string {
+	return dataHeaders
+}
+
+// Returns a client for the data table of the database. The client requires the Finish() call to
+// disconnect from the database when users are finished with it.
+func NewDataClient(dbFile string) (KismetDataClient, error) {
+	table, err := openTableClient(dbFile)
+	if err != nil {
+		return KismetDataClient{}, err
+	}
+
+	return KismetDataClient{tableClient: table}, nil
+}
@@ -0,0 +1,79 @@
+package kismetClient
+
+// The KismetDatasourceClient reads the datasources table of a kismetdb. Every radio that Kismet
+// captured with becomes one element, describing the interface, its hardware and the channels it
+// was tuned to. Datasources have no position, so their coordinates are always 0.
+type KismetDatasourceClient struct {
+	tableClient
+}
+
+var datasourceHeaders = []string{
+	"lat", "lon", "uuid", "name", "interface", "typestring", "definition", "hardware", "channel", "channels",
+	"hop_rate", "packets",
+}
+
+// Returns a generator of the datasources in the database that match the filter
+func (client *KismetDatasourceClient) Elements() (func() (DataElement, error), error) {
+	badFunc := func() (DataElement, error) { return DataElement{}, KismetDBError("Generator not Initialized") }
+
+	if !client.Ready {
+		return badFunc, KismetDBError("DB Client is not ready!")
+	}
+
+	table := client.Schema.Table("datasources")
+	client.query = &tableQuery{
+		db: client.db,
+		schema: client.Schema,
+		table: table,
+		columns: []string{"uuid", "name", "interface", table.Type, "definition", table.JSON},
+		filter: client.Filter,
+	}
+
+	if err := client.query.run() ; err != nil {
+		return badFunc, err
+	}
+
+	return func() (DataElement, error) {
+		row, err := client.query.next()
+		if err != nil || row == nil {
+			return DataElement{}, err
+		}
+
+		record, err := decodeJSONRecord(row[table.JSON])
+		if err != nil {
+			return DataElement{}, err
+		}
+
+		return DataElement{
+			ID: row.string("uuid"),
+			data: []interface{}{
+				row["name"],
+				row["interface"],
+				row[table.Type],
+				row["definition"],
+				fieldAt(record, []string{"kismet.datasource.hardware"}),
+				fieldAt(record, []string{"kismet.datasource.channel"}),
+				fieldAt(record, []string{"kismet.datasource.channels"}),
+				fieldAt(record, []string{"kismet.datasource.hop_rate"}),
+				fieldAt(record, []string{"kismet.datasource.num_packets"}),
+			},
+			extraData: true,
+			HasData: true,
+		}, nil
+	}, nil
+}
+
+func (client *KismetDatasourceClient) ElementHeaders() []string {
+	return datasourceHeaders
+}
+
+// Returns a client for the datasources table of the database. The client requires the Finish()
+// call to disconnect from the database when users are finished with it.
+func NewDatasourceClient(dbFile string) (KismetDatasourceClient, error) {
+	table, err := openTableClient(dbFile)
+	if err != nil {
+		return KismetDatasourceClient{}, err
+	}
+
+	return KismetDatasourceClient{tableClient: table}, nil
+}
@@ -0,0 +1,243 @@
+package kismetClient
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How a merged device is located
+const (
+	// Use the location from the file where the device was heard the loudest
+	MergeBestSignal = "signal"
+	// Average the locations from every file, weighted by the number of packets in each
+	MergeAverage = "average"
+)
+
+// The KismetMergeClient reads the devices tables of several kismetdb files, such as one per
+// sensor or capture session, and merges them into one inventory. A device is identified by its
+// MAC address and PHY, so the same device seen in several files becomes a single element.
+type KismetMergeClient struct {
+	Files []string
+	// The versions of each file, in the order of Files
+	Sources []MergeSource
+
+	// Restricts the devices that are read from each file. Set before calling Elements()
+	Filter QueryFilter
+	// How merged devices are located. One of MergeBestSignal or MergeAverage
+	Location string
+
+	Ready bool
+}
+
+var mergeHeaders = []string{
+	"lat", "lon", "devmac", "phyname", "type", "first_seen", "last_seen", "strongest_signal", "packets", "sources",
+}
+
+// A file that is merged and the versions it was written with
+type MergeSource struct {
+	File string
+	KismetVersion string
+	DBVersion int
+}
+
+// A device as merged so far
+type mergedDevice struct {
+	mac, phy, deviceType string
+	firstSeen, lastSeen time.Time
+	// Kismet records 0 when the signal was never measured
+	strongestSignal int64
+	packets int64
+	sources []string
+
+	// The location from the file with the strongest signal
+	bestLat, bestLon float64
+	bestSignal int64
+	// Sums for the weighted average location
+	latSum, lonSum, weight float64
+}
+
+// Returns a generator of the merged devices, sorted by MAC address and PHY. Every file is read
+// before the first device is returned as a device may appear in any of them.
+func (client *KismetMergeClient) Elements() (func() (DataElement, error), error) {
+	badFunc := func() (DataElement, error) { return DataElement{}, KismetDBError("Generator not Initialized") }
+
+	if !client.Ready {
+		return badFunc, KismetDBError("DB Client is not ready!")
+	}
+
+	if client.Location != MergeBestSignal && client.Location != MergeAverage {
+		return badFunc, KismetDBError(fmt.Sprintf("%q is not a way to locate merged devices", client.Location))
+	}
+
+	devices := make(map[string]*mergedDevice)
+	for _, v := range client.Files {
+		if err := client.mergeFile(v, devices) ; err != nil {
+			return badFunc, err
+		}
+	}
+
+	keys := make([]string, 0, len(devices))
+	for key := range devices {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	offset := 0
+	return func() (DataElement, error) {
+		if offset >= len(keys) { // No more devices left
+			return DataElement{}, nil
+		}
+
+		device := devices[keys[offset]]
+		offset++
+
+		element := DataElement{
+			ID: device.mac,
+			data: []interface{}{
+				device.phy,
+				device.deviceType,
+				device.firstSeen,
+				device.lastSeen,
+				device.strongestSignal,
+				device.packets,
+				strings.Join(device.sources, ","),
+			},
+			extraData: true,
+			HasData: true,
+		}
+
+		if client.Location == MergeAverage && device.weight > 0 {
+			element.Lat = device.latSum / device.weight
+			element.Lon = device.lonSum / device.weight
+		} else {
+			element.Lat, element.Lon = device.bestLat, device.bestLon
+		}
+
+		return element, nil
+	}, nil
+}
+
+// Reads the devices of one file into the merged devices
+func (client *KismetMergeClient) mergeFile(dbFile string, devices map[string]*mergedDevice) error {
+	db, _, _, schema, err := openKismetDB(dbFile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	table := schema.Table("devices")
+	query := tableQuery{
+		db: db,
+		schema: schema,
+		table: table,
+		columns: []string{
+			table.Lat, table.Lon, table.MAC, table.Phy, table.Type, table.FirstTime, table.LastTime, table.Signal,
+			table.JSON,
+		},
+		filter: client.Filter,
+	}
+
+	if err := query.run() ; err != nil {
+		return KismetDBError(fmt.Sprintf("%s: %v", dbFile, err))
+	}
+	defer query.close()
+
+	for {
+		row, err := query.next()
+		if err != nil {
+			return KismetDBError(fmt.Sprintf("%s: %v", dbFile, err))
+		} else if row == nil {
+			return nil
+		}
+
+		record, err := decodeJSONRecord(row[table.JSON])
+		if err != nil {
+			return KismetDBError(fmt.Sprintf("%s: %v", dbFile, err))
+		}
+
+		var (
+			mac = row.string(table.MAC)
+			phy = row.string(table.Phy)
+			key = mac + "/" + phy
+			lat = row.coordinate(schema, table.Lat)
+			lon = row.coordinate(schema, table.Lon)
+			signal = row.int(table.Signal)
+			firstSeen = schema.Timestamp(row[table.FirstTime], nil)
+			lastSeen = schema.Timestamp(row[table.LastTime], nil)
+			packets int64
+		)
+
+		if total, ok := fieldAt(record, []string{"kismet.device.base.packets.total"}).(int64) ; ok {
+			packets = total
+		}
+
+		device, ok := devices[key]
+		if !ok {
+			device = &mergedDevice{mac: mac, phy: phy, firstSeen: firstSeen, lastSeen: lastSeen}
+			devices[key] = device
+		}
+
+		if device.deviceType == "" {
+			device.deviceType = row.string(table.Type)
+		}
+		if firstSeen.Before(device.firstSeen) {
+			device.firstSeen = firstSeen
+		}
+		if lastSeen.After(device.lastSeen) {
+			device.lastSeen = lastSeen
+		}
+		if signal != 0 && (device.strongestSignal == 0 || signal > device.strongestSignal) {
+			device.strongestSignal = signal
+		}
+		device.packets += packets
+		device.sources = append(device.sources, dbFile)
+
+		// Devices that were never seen with a GPS fix have no location to merge
+		if lat == 0 && lon == 0 {
+			continue
+		}
+
+		if (device.bestLat == 0 && device.bestLon == 0) || (signal != 0 && (device.bestSignal == 0 || signal > device.bestSignal)) {
+			device.bestLat, device.bestLon, device.bestSignal = lat, lon, signal
+		}
+
+		weight := float64(packets)
+		if weight == 0 {
+			weight = 1
+		}
+		device.latSum += lat * weight
+		device.lonSum += lon * weight
+		device.weight += weight
+	}
+}
+
+func (client *KismetMergeClient) ElementHeaders() []string {
+	return mergeHeaders
+}
+
+// Returns a client that merges the devices of the files. Every file is checked to be a kismetdb
+// that can be read before any of them are merged.
+func NewMergeClient(dbFiles []string) (KismetMergeClient, error) {
+	if len(dbFiles) == 0 {
+		return KismetMergeClient{}, KismetDBError("No files to merge")
+	}
+
+	sources := make([]MergeSource, 0, len(dbFiles))
+	for _, v := range dbFiles {
+		db, kismetVersion, dbVersion, _, err := openKismetDB(v)
+		if err != nil {
+			return KismetMergeClient{}, KismetDBError(fmt.Sprintf("%s: %v", v, err))
+		}
+		db.Close()
+		sources = append(sources, MergeSource{v, kismetVersion, dbVersion})
+	}
+
+	return KismetMergeClient{
+		Files: dbFiles,
+		Sources: sources,
+		Location: MergeBestSignal,
+		Ready: true,
+	}, nil
+}
@@ -0,0 +1,68 @@
+package kismetClient
+
+// The KismetMessageClient reads the messages table of a kismetdb. These are the messages the
+// Kismet server logged while capturing, such as new devices being found or a datasource failing.
+// Messages have no device, so the type of the message takes the place of the ID.
+type KismetMessageClient struct {
+	tableClient
+}
+
+var messageHeaders = []string{
+	"lat", "lon", "msgtype", "timestamp", "message",
+}
+
+// Returns a generator of the messages in the database that match the filter
+func (client *KismetMessageClient) Elements() (func() (DataElement, error), error) {
+	badFunc := func() (DataElement, error) { return DataElement{}, KismetDBError("Generator not Initialized") }
+
+	if !client.Ready {
+		return badFunc, KismetDBError("DB Client is not ready!")
+	}
+
+	table := client.Schema.Table("messages")
+	client.query = &tableQuery{
+		db: client.db,
+		schema: client.Schema,
+		table: table,
+		columns: []string{table.Lat, table.Lon, table.Type, table.FirstTime, "message"},
+		filter: client.Filter,
+	}
+
+	if err := client.query.run() ; err != nil {
+		return badFunc, err
+	}
+
+	return func() (DataElement, error) {
+		row, err := client.query.next()
+		if err != nil || row == nil {
+			return DataElement{}, err
+		}
+
+		return DataElement{
+			ID: row.string(table.Type),
+			Lat: row.coordinate(client.Schema, table.Lat),
+			Lon: row.coordinate(client.Schema, table.Lon),
+			data: []interface{}{
+				client.Schema.Timestamp(row[table.FirstTime], nil),
+				row["message"],
+			},
+			extraData: true,
+			HasData: true,
+		}, nil
+	}, nil
+}
+
+func (client *KismetMessageClient) ElementHeaders() []string {
+	return messageHeaders
+}
+
+// Returns a client for the messages table of the database. The client requires the Finish()
+// call to disconnect from the database when users are finished with it.
+func NewMessageClient(dbFile string) (KismetMessageClient, error) {
+	table, err := openTableClient(dbFile)
+	if err != nil {
+		return KismetMessageClient{}, err
+	}
+
+	return KismetMessageClient{tableClient: table}, nil
+}
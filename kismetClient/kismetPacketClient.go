@@ -0,0 +1,234 @@
+package kismetClient
+
+import (
+	"time"
+)
+
+// The KismetPacketClient reads the packets table of a kismetdb. Every packet that was captured
+// with a GPS fix becomes one element, so the elements are individual observations of a device
+// rather than the summary of the device that the devices table holds.
+type KismetPacketClient struct {
+	tableClient
+
+	// Keep only every Nth packet with a GPS fix. 0 and 1 keep every packet
+	SampleEvery int
+	// Keep only the first packet from each source MAC address in every interval of this
+	// length. 0 keeps every packet
+	SampleInterval time.Duration
+}
+
+var packetHeaders = []string{
+	"lat", "lon", "sourcemac", "timestamp", "destmac", "transmac", "frequency", "signal", "datasource", "alt",
+}
+
+// Returns the packet columns, in the order of packetHeaders, that are read from the table. The
+// packet itself is never read.
+func packetColumns(table TableSchema) []string {
+	return []string{
+		table.Lat, table.Lon, table.MAC, table.FirstTime, table.SubTime, table.DestMAC, table.TransMAC,
+		table.Frequency, table.Signal, table.Datasource, table.Alt,
+	}
+}
+
+// Only packets that were captured with a GPS fix have a position. Kismet records 0 for both
+// coordinates when there was no fix.
+func gpsFixCondition(table TableSchema) string {
+	lat, _ := quoteIdentifier(table.Lat)
+	lon, _ := quoteIdentifier(table.Lon)
+	return "(" + lat + " != 0 or " + lon + " != 0)"
+}
+
+// Returns a generator of the geotagged packets in the database that match the filter, after
+// sampling.
+func (client *KismetPacketClient) Elements() (func() (DataElement, error), error) {
+	badFunc := func() (DataElement, error) { return DataElement{}, KismetDBError("Generator not Initialized") }
+
+	if !client.Ready {
+		return badFunc, KismetDBError("DB Client is not ready!")
+	}
+
+	table := client.Schema.Table("packets")
+	client.query = &tableQuery{
+		db: client.db,
+		schema: client.Schema,
+		table: table,
+		columns: packetColumns(table),
+		filter: client.Filter,
+		conditions: []string{gpsFixCondition(table)},
+		// Sampling by interval needs the packets of each source in the order they were captured
+		suffix: timeOrder(table),
+	}
+
+	if err := client.query.run() ; err != nil {
+		return badFunc, err
+	}
+
+	var (
+		seen = 0
+		// The sampling interval each source MAC address was last kept in
+		lastBucket = make(map[string]int64)
+	)
+
+	return func() (DataElement, error) {
+		for {
+			row, err := client.query.next()
+			if err != nil || row == nil {
+				return DataElement{}, err
+			}
+
+			timestamp := client.Schema.Timestamp(row[table.FirstTime], row[table.SubTime])
+			sourceMAC := row.string(table.MAC)
+
+			seen++
+			if client.SampleEvery > 1 && (seen - 1) % client.SampleEvery != 0 {
+				continue
+			}
+
+			if client.SampleInterval > 0 {
+				bucket := timestamp.UnixNano() / int64(client.SampleInterval)
+				if last, ok := lastBucket[sourceMAC] ; ok && last == bucket {
+					continue
+				}
+				lastBucket[sourceMAC] = bucket
+			}
+
+			return DataElement{
+				ID: sourceMAC,
+				Lat: row.coordinate(client.Schema, table.Lat),
+				Lon: row.coordinate(client.Schema, table.Lon),
+				data: []interface{}{
+					timestamp,
+					row[table.DestMAC],
+					row[table.TransMAC],
+					row[table.Frequency],
+					row[table.Signal],
+					row[table.Datasource],
+					row.coordinate(client.Schema, table.Alt),
+				},
+				extraData: true,
+				HasData: true,
+			}, nil
+		}
+	}, nil
+}
+
+func (client *KismetPacketClient) ElementHeaders() []string {
+	return packetHeaders
+}
+
+// A RawPacket is a captured frame as Kismet logged it, with where and how it was captured
+type RawPacket struct {
+	Timestamp time.Time
+	// The link type of the frame, such as 127 for 802.11 with a radiotap header
+	DLT int64
+	// The UUID of the datasource that captured the frame
+	Datasource string
+	// The frame as captured. Kismet may have logged only the start of the frame
+	Data []byte
+	// The length of the frame before Kismet logged it. The same as len(Data) if unknown
+	OriginalLength int64
+
+	SourceMAC string
+	Signal int64
+	// The position at capture. HasFix is false when there was no GPS fix
+	Lat, Lon, Alt float64
+	HasFix bool
+}
+
+// Returns a generator of every packet in the database that matches the filter, with or without
+// a GPS fix, in the order they were captured. Sampling doesn't apply to raw packets. The
+// generator returns a nil packet once there are no more packets.
+func (client *KismetPacketClient) RawPackets() (func() (*RawPacket, error), error) {
+	badFunc := func() (*RawPacket, error) { return nil, KismetDBError("Generator not Initialized") }
+
+	if !client.Ready {
+		return badFunc, KismetDBError("DB Client is not ready!")
+	}
+
+	table := client.Schema.Table("packets")
+	client.query = &tableQuery{
+		db: client.db,
+		schema: client.Schema,
+		table: table,
+		columns: []string{
+			table.Lat, table.Lon, table.Alt, table.MAC, table.FirstTime, table.SubTime, table.Signal,
+			table.Datasource, "dlt", "packet", "packet_full_len",
+		},
+		filter: client.Filter,
+		suffix: timeOrder(table),
+	}
+
+	if err := client.query.run() ; err != nil {
+		return badFunc, err
+	}
+
+	return func() (*RawPacket, error) {
+		row, err := client.query.next()
+		if err != nil || row == nil {
+			return nil, err
+		}
+
+		packet := &RawPacket{
+			Timestamp: client.Schema.Timestamp(row[table.FirstTime], row[table.SubTime]),
+			DLT: row.int("dlt"),
+			Datasource: row.string(table.Datasource),
+			SourceMAC: row.string(table.MAC),
+			Signal: row.int(table.Signal),
+			Lat: row.coordinate(client.Schema, table.Lat),
+			Lon: row.coordinate(client.Schema, table.Lon),
+			Alt: row.coordinate(client.Schema, table.Alt),
+		}
+		packet.HasFix = packet.Lat != 0 || packet.Lon != 0
+
+		switch data := row["packet"].(type) {
+		case Blob:
+			packet.Data = data
+		case string:
+			packet.Data = []byte(data)
+		}
+
+		packet.OriginalLength = row.int("packet_full_len")
+		if packet.OriginalLength < int64(len(packet.Data)) {
+			packet.OriginalLength = int64(len(packet.Data))
+		}
+
+		return packet, nil
+	}, nil
+}
+
+// Returns the names of the datasources in the database by their UUID
+func (client *KismetPacketClient) DatasourceNames() (map[string]string, error) {
+	query := tableQuery{
+		db: client.db,
+		schema: client.Schema,
+		table: client.Schema.Table("datasources"),
+		columns: []string{"uuid", "name"},
+	}
+
+	if err := query.run() ; err != nil {
+		return nil, err
+	}
+	defer query.close()
+
+	names := make(map[string]string)
+	for {
+		row, err := query.next()
+		if err != nil {
+			return nil, err
+		} else if row == nil {
+			return names, nil
+		}
+		names[row.string("uuid")] = row.string("name")
+	}
+}
+
+// Returns a client for the packets table of the database. The client requires the Finish() call
+// to disconnect from the database when users are finished with it.
+func NewPacketClient(dbFile string) (KismetPacketClient, error) {
+	table, err := openTableClient(dbFile)
+	if err != nil {
+		return KismetPacketClient{}, err
+	}
+
+	return KismetPacketClient{tableClient: table}, nil
+}
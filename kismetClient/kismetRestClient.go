@@ -2,6 +2,7 @@ package kismetClient
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,30 +10,45 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 )
 
+// The KismetRestClient reads devices from the REST API of a Kismet server. Each client has its
+// own HTTP client and login, so several clients can talk to different servers at the same time,
+// and one client can be used from several goroutines. Every call has a variant that takes a
+// context, and Finish() cancels the requests that are still in flight.
 type KismetRestClient struct {
 	Url        string
 	Ready      bool
 	AuthCookie http.Cookie
 	Filters    []string
-}
 
-var (
-	httpClient http.Client
-	request *http.Request
-)
+	// Makes the requests. Its timeouts and transport can be changed by passing a client of
+	// your own to NewRestClientContext()
+	HTTPClient *http.Client
+
+	// Closed by Finish() to cancel the requests in flight. Copies of the client share it
+	done chan struct{}
+	finish *sync.Once
+}
 
 const (
 	authPath = "/session/check_login"
 	authCheckPath = "/session/check_session"
 	customQueryPath = "/devices/summary/devices.json"
+	statusPath = "/system/status.json"
+	alertsPath = "/alerts/all_alerts.json"
 	kismetAuthCookieName = "KISMET"
 )
 
 // Make the kismet request for the devices with their filters and return a function generator
 // that returns single device information.
 func (client *KismetRestClient) Elements() (func() (DataElement, error), error) {
+	return client.ElementsContext(context.Background())
+}
+
+// Like Elements(), with the request cancelled when ctx is
+func (client *KismetRestClient) ElementsContext(ctx context.Context) (func() (DataElement, error), error) {
 	var (
 		// Needed to create a JSON string
 		jsonRequestObj = map[string][]string{
@@ -46,7 +62,7 @@ func (client *KismetRestClient) Elements() (func() (DataElement, error), error)
 		assembledJson []map[string]interface{}
 	)
 
-	if !client.Ready {
+	if !client.Ready || client.finished() {
 		return badFunc, KismetRestError("Client is not ready")
 	}
 
@@ -64,19 +80,27 @@ func (client *KismetRestClient) Elements() (func() (DataElement, error), error)
 		jsonLen := len(jsonBytes) + 5 // json=
 		jsonReader := io.MultiReader(strings.NewReader("json="), bytes.NewReader(jsonBytes))
 
+		requestCtx, cancel := client.requestContext(ctx)
+		defer cancel()
+
 		// Create the HTTP Request
-		if newRequest, err := http.NewRequest("POST", client.Url + customQueryPath, jsonReader) ; err == nil {
-			// Success
-			request = newRequest
+		if request, err := http.NewRequest("POST", client.Url + customQueryPath, jsonReader) ; err == nil {
+			request = request.WithContext(requestCtx)
 
 			// Add relevant parts to the HTTP Request
 			request.AddCookie(&client.AuthCookie)
 			request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 			request.Header.Add("Charset", "utf-8")
-			request.Header.Add("Content-Length", strconv.Itoa(jsonLen))
+			// The http package sends the body chunked and drops the header unless it knows the length
+			request.ContentLength = int64(jsonLen)
 
 			// Send the request and handle the response
-			if newResponse, err := httpClient.Do(request) ; err == nil { // Returns JSON doc
+			if newResponse, err := client.httpClient().Do(request) ; err == nil { // Returns JSON doc
+				defer newResponse.Body.Close()
+				if newResponse.StatusCode != http.StatusOK {
+					return badFunc, KismetRestError(fmt.Sprint("Kismet refused the request: ", newResponse.Status))
+				}
+
 				if jsonResponse, err := ioutil.ReadAll(newResponse.Body) ; err == nil { // Read JSON doc
 					if !json.Valid(jsonResponse) { // Validate JSON doc
 						return badFunc, KismetRestError(fmt.Sprint("Got invalid JSON from Kismet with filters:", client.Filters))
@@ -86,12 +110,12 @@ func (client *KismetRestClient) Elements() (func() (DataElement, error), error)
 					if err := json.Unmarshal(jsonResponse, &assembledJson) ; err != nil {
 						return badFunc, KismetRestError(fmt.Sprint("Failed to decode JSON response:", err))
 					}
+				} else { // A partial response is no better than no response
+					return badFunc, KismetRestError(fmt.Sprint("Failed to read response from Kismet: ", err))
 				}
-				newResponse.Body.Close()
 			} else {
-				return badFunc, KismetRestError(fmt.Sprint("Error handling HTTP request", err))
+				return badFunc, KismetRestError(fmt.Sprint("Error handling HTTP request: ", err))
 			}
-			request.Body.Close()
 		} else {
 			return badFunc, KismetRestError(fmt.Sprint("Failed to create HTTP request:", err))
 		}
@@ -104,8 +128,8 @@ func (client *KismetRestClient) Elements() (func() (DataElement, error), error)
 	return func() (DataElement, error) {
 		element := DataElement{}
 
-		if offset >= numDevices {
-			return element, KismetRestError("No more devices left")
+		if offset >= numDevices { // No more devices left
+			return element, nil
 		}
 
 		device := assembledJson[offset]
@@ -123,11 +147,12 @@ func (client *KismetRestClient) Elements() (func() (DataElement, error), error)
 		element.Lat = float64(device[responseFilters[0]].(float64))
 		element.Lon = float64(device[responseFilters[1]].(float64))
 
-		switch id := device[responseFilters[2]]; id.(type) {
+		// JSON numbers are all float64
+		switch id := device[responseFilters[2]].(type) {
 		case string:
-			element.ID = id.(string)
-		case int:
-			element.ID = string(id.(int))
+			element.ID = id
+		case float64:
+			element.ID = strconv.FormatFloat(id, 'f', -1, 64)
 		default:
 			return element, KismetRestError(
 				fmt.Sprint("Invalid ID field from parsed data:", device[responseFilters[2]]))
@@ -142,6 +167,7 @@ func (client *KismetRestClient) Elements() (func() (DataElement, error), error)
 			for n, filter := range responseFilters[3:] {
 				extraData[n] = device[filter]
 			}
+			element.data = extraData
 		}
 
 		offset++
@@ -152,30 +178,43 @@ func (client *KismetRestClient) Elements() (func() (DataElement, error), error)
 // Returns a Kismet Web Client ready to make REST API requests. This method will make Web API requests in order
 // to retrieve the authentication token
 func NewRestClient(url, username, password string, filters []string) (KismetRestClient, error) {
+	return NewRestClientContext(context.Background(), nil, url, username, password, filters)
+}
+
+// Like NewRestClient(), with the login requests cancelled when ctx is. The client makes its
+// requests with httpClient, or with an HTTP client of its own if httpClient is nil.
+func NewRestClientContext(ctx context.Context, httpClient *http.Client, url, username, password string,
+	filters []string) (KismetRestClient, error) {
 	var (
 		authCookie http.Cookie
 	)
 
-	if newRequest, err := http.NewRequest("GET", url + authPath, strings.NewReader("")) ; err == nil {
-		// Creating the request was successful, so lets just store the request for when we use it :D
-		request = newRequest
-		defer request.Body.Close()
-	} else { // Creating the request was not successful
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+
+	request, err := http.NewRequest("GET", url + authPath, nil)
+	if err != nil { // Creating the request was not successful
 		return KismetRestClient{}, KismetRestError(fmt.Sprintf("Failed to create request to %s.\n" +
 			"Perhaps you forgot to add http:// to the beginning of the url?", url))
 	}
 
+	request = request.WithContext(ctx)
 	request.SetBasicAuth(username, password)
 
-	if newResponse, err := httpClient.Do(request) ; err == nil && newResponse.StatusCode == 200 {
-		// Performing the request was successful
-		for _, cookie := range newResponse.Cookies() {
-			if cookie.Name == kismetAuthCookieName {
-				authCookie = *cookie // Copy :D
+	if newResponse, err := httpClient.Do(request) ; err == nil {
+		if newResponse.StatusCode == http.StatusOK {
+			// Performing the request was successful
+			for _, cookie := range newResponse.Cookies() {
+				if cookie.Name == kismetAuthCookieName {
+					authCookie = *cookie // Copy :D
+				}
 			}
 		}
-		defer newResponse.Body.Close()
-	} // Don't check for this error (err) case.
+		newResponse.Body.Close()
+	} else if ctx.Err() != nil {
+		return KismetRestClient{}, KismetRestError(fmt.Sprint("Logging in to Kismet was cancelled: ", ctx.Err()))
+	} // Don't check for other errors (err).
 	// If the kismet cookie isn't set, we check below which ends up covering this error case
 
 	if authCookie.Name != kismetAuthCookieName {
@@ -189,9 +228,12 @@ func NewRestClient(url, username, password string, filters []string) (KismetRest
 		true,
 		authCookie,
 		filters,
+		httpClient,
+		make(chan struct{}),
+		&sync.Once{},
 	}
 
-	if kismetClient.ValidConnection() {
+	if kismetClient.ValidConnectionContext(ctx) {
 		return kismetClient, nil
 	} else {
 		return KismetRestClient{}, KismetRestError("Failed to validate authentication cookie.")
@@ -200,22 +242,117 @@ func NewRestClient(url, username, password string, filters []string) (KismetRest
 
 // Tests for a valid connection. The implementation tests the Kismet authentication cookie.
 func (client *KismetRestClient) ValidConnection() bool {
-	if newRequest, err := http.NewRequest("GET", client.Url + authCheckPath, strings.NewReader("")) ; err == nil {
-		request = newRequest
-		defer request.Body.Close()
-	} else {
+	return client.ValidConnectionContext(context.Background())
+}
+
+// Like ValidConnection(), with the request cancelled when ctx is
+func (client *KismetRestClient) ValidConnectionContext(ctx context.Context) bool {
+	requestCtx, cancel := client.requestContext(ctx)
+	defer cancel()
+
+	request, err := http.NewRequest("GET", client.Url + authCheckPath, nil)
+	if err != nil {
 		return false
 	}
 
+	request = request.WithContext(requestCtx)
 	request.AddCookie(&client.AuthCookie) // DOH
 
-	if response, err := httpClient.Do(request) ; err == nil && response.StatusCode == 200 {
-		return true
+	if response, err := client.httpClient().Do(request) ; err == nil {
+		response.Body.Close()
+		return response.StatusCode == http.StatusOK
 	}
 
 	return false
 }
 
+// Returns the HTTP client requests are made with. Clients that weren't made by NewRestClient()
+// use the default one of the http package.
+func (client *KismetRestClient) httpClient() *http.Client {
+	if client.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return client.HTTPClient
+}
+
+// Returns true once Finish() has been called on the client or a copy of it
+func (client *KismetRestClient) finished() bool {
+	select {
+	case <-client.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns a context for a request that is cancelled when ctx is or when the client is finished
+func (client *KismetRestClient) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	requestCtx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		select {
+		case <-client.done:
+			cancel()
+		case <-requestCtx.Done():
+		}
+	}()
+
+	return requestCtx, cancel
+}
+
 func (client *KismetRestClient) ElementHeaders() []string {
 	return client.Filters
 }
+
+// Asks the Kismet server which version of Kismet it is running.
+func (client *KismetRestClient) ServerVersion() (string, error) {
+	return client.ServerVersionContext(context.Background())
+}
+
+// Like ServerVersion(), with the request cancelled when ctx is
+func (client *KismetRestClient) ServerVersionContext(ctx context.Context) (string, error) {
+	var status map[string]interface{}
+
+	if err := client.getJSON(ctx, statusPath, &status) ; err != nil {
+		return "", err
+	}
+
+	if version, ok := status["kismet.system.version"].(string) ; ok {
+		return version, nil
+	}
+
+	return "", KismetRestError("Kismet did not report its version")
+}
+
+// Reads a JSON document from the Kismet server into result
+func (client *KismetRestClient) getJSON(ctx context.Context, path string, result interface{}) error {
+	var jsonRequest *http.Request
+
+	requestCtx, cancel := client.requestContext(ctx)
+	defer cancel()
+
+	if newRequest, err := http.NewRequest("GET", client.Url + path, nil) ; err == nil {
+		jsonRequest = newRequest.WithContext(requestCtx)
+	} else {
+		return KismetRestError(fmt.Sprint("Failed to create HTTP request:", err))
+	}
+
+	jsonRequest.AddCookie(&client.AuthCookie)
+
+	if response, err := client.httpClient().Do(jsonRequest) ; err == nil {
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return KismetRestError(fmt.Sprint("Kismet refused the request: ", response.Status))
+		}
+
+		decoder := json.NewDecoder(response.Body)
+		decoder.UseNumber() // Keep integers as integers, like the records in a kismetdb
+		if err := decoder.Decode(result) ; err != nil {
+			return KismetRestError(fmt.Sprint("Failed to decode JSON response:", err))
+		}
+	} else {
+		return KismetRestError(fmt.Sprint("Error handling HTTP request: ", err))
+	}
+
+	return nil
+}
@@ -0,0 +1,250 @@
+package kismetClient
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// The ways the coordinates returned by an SQL query can be stored
+const (
+	// The way the database stores them, which depends on its version
+	CoordinatesAuto = "auto"
+	// Integers scaled by coordinateScale, like in version 4 databases
+	CoordinatesScaled = "scaled"
+	// Degrees
+	CoordinatesReal = "real"
+)
+
+// Returned by NewSQLClient for a statement that isn't a query, such as a delete. Those return no
+// columns.
+const ErrNotSelect = KismetDBError("The statement returns no columns. Only select statements can be run")
+
+// A KismetSQLClient runs a query written by the user against a kismetdb, for anything the table
+// and column filters can't express, such as joins, aggregates and the SQLite JSON functions. The
+// database is opened read-only, so the query can't change it. The result columns chosen as the
+// latitude, longitude and ID become those of the elements and the other columns become the extra
+// data, in the order of the query.
+type KismetSQLClient struct {
+	db *sql.DB
+	rows *sql.Rows
+
+	Query string
+	// The names of the result columns holding the latitude, longitude and ID. An empty ID uses the
+	// first column that is neither of the others. Set before calling Elements()
+	LatColumn string
+	LonColumn string
+	IDColumn string
+	// How the latitude and longitude are stored, one of the Coordinates constants. Set before
+	// calling Elements()
+	Coordinates string
+
+	// The contents of the KISMET table of the database
+	KismetVersion string
+	DBVersion int
+	// How this version of the database stores its data
+	Schema *KismetSchema
+
+	Ready bool
+
+	resultColumns []string
+	resultTypes []string
+}
+
+// Opens the database and runs the query, so that its columns are known. The client must be
+// cleaned up with Finish().
+func NewSQLClient(dbFile, query string) (KismetSQLClient, error) {
+	db, kismetVersion, dbVersion, schema, err := openKismetDB(dbFile)
+	if err != nil {
+		return KismetSQLClient{}, err
+	}
+
+	rows, err := db.Query(query)
+	if err != nil {
+		db.Close()
+		return KismetSQLClient{}, KismetDBError(fmt.Sprint("Query failed: ", err))
+	}
+
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		rows.Close()
+		db.Close()
+		return KismetSQLClient{}, KismetDBError(fmt.Sprint("Failed to read column types: ", err))
+	}
+
+	if len(columnTypes) == 0 {
+		rows.Close()
+		db.Close()
+		return KismetSQLClient{}, ErrNotSelect
+	}
+
+	client := KismetSQLClient{
+		db: db,
+		rows: rows,
+		Query: query,
+		LatColumn: "lat",
+		LonColumn: "lon",
+		Coordinates: CoordinatesAuto,
+		KismetVersion: kismetVersion,
+		DBVersion: dbVersion,
+		Schema: schema,
+		Ready: true,
+	}
+
+	for _, v := range columnTypes {
+		client.resultColumns = append(client.resultColumns, v.Name())
+		client.resultTypes = append(client.resultTypes, v.DatabaseTypeName())
+	}
+
+	return client, nil
+}
+
+// Returns the positions of the result columns in the order of the elements: the latitude,
+// longitude and ID, then the rest
+func (client *KismetSQLClient) layout() ([]int, error) {
+	find := func(name, flag string) (int, error) {
+		for i, v := range client.resultColumns {
+			if v == name {
+				return i, nil
+			}
+		}
+		return 0, KismetDBError(fmt.Sprintf("The query has no %s column %q. Its columns are: %v", flag, name,
+			client.resultColumns))
+	}
+
+	lat, err := find(client.LatColumn, "latitude")
+	if err != nil {
+		return nil, err
+	}
+	lon, err := find(client.LonColumn, "longitude")
+	if err != nil {
+		return nil, err
+	}
+
+	id := -1
+	if client.IDColumn != "" {
+		if id, err = find(client.IDColumn, "ID") ; err != nil {
+			return nil, err
+		}
+	} else {
+		for i := range client.resultColumns {
+			if i != lat && i != lon {
+				id = i
+				break
+			}
+		}
+		if id < 0 {
+			return nil, KismetDBError("The query needs a column for the ID besides the latitude and longitude")
+		}
+	}
+
+	order := []int{lat, lon, id}
+	for i := range client.resultColumns {
+		if i != lat && i != lon && i != id {
+			order = append(order, i)
+		}
+	}
+
+	return order, nil
+}
+
+// Returns a generator over the rows of the query
+func (client *KismetSQLClient) Elements() (func() (DataElement, error), error) {
+	badFunc := func () (DataElement, error) { return DataElement{}, KismetDBError("Generator not Initialized") }
+
+	if !client.Ready {
+		return badFunc, KismetDBError("DB Client is not ready!")
+	}
+
+	order, err := client.layout()
+	if err != nil {
+		return badFunc, err
+	}
+
+	// Decode the coordinates like a database that stores them the way the query returns them
+	schema := *client.Schema
+	switch client.Coordinates {
+	case CoordinatesAuto:
+	case CoordinatesScaled:
+		schema.ScaledCoordinates = true
+	case CoordinatesReal:
+		schema.ScaledCoordinates = false
+	default:
+		return badFunc, KismetDBError(fmt.Sprintf("Unknown coordinate encoding %q", client.Coordinates))
+	}
+
+	// The query decides what each column holds, whatever the table declares
+	rowContent := make([]interface{}, len(client.resultColumns))
+	for i := range rowContent {
+		rowContent[i] = new(interface{})
+	}
+
+	return func() (DataElement, error) {
+		returnElement := DataElement{}
+
+		if !client.rows.Next() {
+			// Next() also returns false when iterating failed part way through
+			if err := client.rows.Err() ; err != nil {
+				return returnElement, KismetDBError(fmt.Sprint("Failed to read from database: ", err))
+			}
+			return returnElement, nil // No more rows left
+		}
+
+		if err := client.rows.Scan(rowContent...) ; err != nil {
+			return returnElement, KismetDBError(fmt.Sprint("Failed to parse database: ", err))
+		}
+
+		values := make([]interface{}, len(order))
+		for i, v := range order {
+			values[i] = scannedValue(rowContent[v])
+		}
+
+		if returnElement.Lat, err = schema.Coordinate(values[0]) ; err != nil {
+			return returnElement, KismetDBError(fmt.Sprintf("Bad latitude in %s: %v", client.LatColumn, err))
+		}
+		if returnElement.Lon, err = schema.Coordinate(values[1]) ; err != nil {
+			return returnElement, KismetDBError(fmt.Sprintf("Bad longitude in %s: %v", client.LonColumn, err))
+		}
+
+		if values[2] != nil {
+			returnElement.ID = fmt.Sprint(values[2])
+		}
+
+		returnElement.HasData = true
+		if len(values) > 3 {
+			returnElement.extraData = true
+			returnElement.data = values[3:]
+		}
+
+		return returnElement, nil
+	}, nil
+}
+
+// Returns the names of the result columns in the order of the elements. Before the latitude,
+// longitude and ID columns are found, they are in the order of the query.
+func (client *KismetSQLClient) ElementHeaders() []string {
+	order, err := client.layout()
+	if err != nil {
+		return client.resultColumns
+	}
+
+	headers := make([]string, len(order))
+	for i, v := range order {
+		headers[i] = client.resultColumns[v]
+	}
+	return headers
+}
+
+// Returns the types SQLite declares for the result columns in the order of the elements. Columns
+// that aren't read straight from a table column have no type.
+func (client *KismetSQLClient) ColumnTypes() []string {
+	order, err := client.layout()
+	if err != nil {
+		return client.resultTypes
+	}
+
+	types := make([]string, len(order))
+	for i, v := range order {
+		types[i] = client.resultTypes[v]
+	}
+	return types
+}
@@ -0,0 +1,258 @@
+package kismetClient
+
+import (
+	"fmt"
+	"time"
+)
+
+// A KismetSchema describes how one version of the kismetdb layout stores its data. Kismet records
+// the version in the db_version column of the KISMET table. Clients use the schema for the
+// version of the database they are reading instead of guessing from the column types, as the
+// same column has been stored differently over the years.
+type KismetSchema struct {
+	// The db_version this schema is for
+	Version int
+	// Versions before 5 stored coordinates as integers scaled by 100000. Later versions store
+	// them as reals.
+	ScaledCoordinates bool
+	// The unit of the second based timestamp columns (first_time, last_time, ts_sec)
+	TimeUnit time.Duration
+	// The unit of the sub second timestamp columns (ts_usec)
+	SubTimeUnit time.Duration
+
+	tables map[string]TableSchema
+}
+
+// Describes a single table of a kismetdb. Columns are found by what they mean so that clients
+// don't have to care what a version calls them. A column that a table does not have is empty.
+type TableSchema struct {
+	// The name of the table in the database
+	Name string
+
+	// The columns for the coordinates of the row
+	Lat string
+	Lon string
+	Alt string
+	// Every column that holds a latitude, longitude or altitude and is encoded like them
+	Coordinates []string
+
+	// The time the row was first and last seen. Tables that record single events use the
+	// same column for both
+	FirstTime string
+	LastTime  string
+	// The sub second part of the timestamp, if the table has one
+	SubTime string
+
+	// The MAC address of the device that is the subject of the row
+	MAC string
+	// Other columns that hold MAC addresses
+	OtherMACs []string
+	// The destination and transmitter MAC addresses of a packet
+	DestMAC  string
+	TransMAC string
+	// The Kismet PHY of the row, such as IEEE802.11
+	Phy string
+	// The signal strength in dBm
+	Signal string
+	// The frequency the row was captured on, in kHz
+	Frequency string
+	// The kind of device, such as Wi-Fi AP
+	Type string
+	// The datasource that produced the row
+	Datasource string
+	// The column holding the JSON record of the row
+	JSON string
+}
+
+// Returns true if the column holds a coordinate
+func (table TableSchema) IsCoordinate(column string) bool {
+	for _, v := range table.Coordinates {
+		if v == column {
+			return true
+		}
+	}
+	return false
+}
+
+// The oldest and newest kismetdb versions this package knows how to read
+const (
+	MinDBVersion = 4
+	MaxDBVersion = 9
+)
+
+// The layout of the tables has been stable since version 4 apart from the coordinate encoding
+// and columns being added at the end of tables, which don't change how existing columns are read.
+func kismetTables() map[string]TableSchema {
+	return map[string]TableSchema{
+		"devices": {
+			Name:        "devices",
+			Lat:         "avg_lat",
+			Lon:         "avg_lon",
+			Coordinates: []string{"min_lat", "min_lon", "max_lat", "max_lon", "avg_lat", "avg_lon"},
+			FirstTime:   "first_time",
+			LastTime:    "last_time",
+			MAC:         "devmac",
+			Phy:         "phyname",
+			Signal:      "strongest_signal",
+			Type:        "type",
+			JSON:        "device",
+		},
+		"packets": {
+			Name:        "packets",
+			Lat:         "lat",
+			Lon:         "lon",
+			Alt:         "alt",
+			Coordinates: []string{"lat", "lon", "alt"},
+			FirstTime:   "ts_sec",
+			LastTime:    "ts_sec",
+			SubTime:     "ts_usec",
+			MAC:         "sourcemac",
+			OtherMACs:   []string{"destmac", "transmac"},
+			DestMAC:     "destmac",
+			TransMAC:    "transmac",
+			Phy:         "phyname",
+			Signal:      "signal",
+			Frequency:   "frequency",
+			Datasource:  "datasource",
+		},
+		"data": {
+			Name:        "data",
+			Lat:         "lat",
+			Lon:         "lon",
+			Alt:         "alt",
+			Coordinates: []string{"lat", "lon", "alt"},
+			FirstTime:   "ts_sec",
+			LastTime:    "ts_sec",
+			SubTime:     "ts_usec",
+			MAC:         "devmac",
+			Phy:         "phyname",
+			Type:        "type",
+			Datasource:  "datasource",
+			JSON:        "json",
+		},
+		"alerts": {
+			Name:        "alerts",
+			Lat:         "lat",
+			Lon:         "lon",
+			Coordinates: []string{"lat", "lon"},
+			FirstTime:   "ts_sec",
+			LastTime:    "ts_sec",
+			SubTime:     "ts_usec",
+			MAC:         "devmac",
+			Phy:         "phyname",
+			Type:        "header",
+			JSON:        "json",
+		},
+		"datasources": {
+			Name: "datasources",
+			Type: "typestring",
+			JSON: "json",
+		},
+		"messages": {
+			Name:        "messages",
+			Lat:         "lat",
+			Lon:         "lon",
+			Coordinates: []string{"lat", "lon"},
+			FirstTime:   "ts_sec",
+			LastTime:    "ts_sec",
+			Type:        "msgtype",
+		},
+		"snapshots": {
+			Name:        "snapshots",
+			Lat:         "lat",
+			Lon:         "lon",
+			Coordinates: []string{"lat", "lon"},
+			FirstTime:   "ts_sec",
+			LastTime:    "ts_sec",
+			SubTime:     "ts_usec",
+			Type:        "snaptype",
+			JSON:        "json",
+		},
+	}
+}
+
+// Returns the schema for a kismetdb version, or an error explaining why the version can't be read.
+func SchemaForVersion(version int) (*KismetSchema, error) {
+	if version < MinDBVersion {
+		return nil, KismetDBError(fmt.Sprintf("kismetdb version %d is older than the oldest supported version (%d). "+
+			"It was written by a development release of Kismet", version, MinDBVersion))
+	} else if version > MaxDBVersion {
+		return nil, KismetDBError(fmt.Sprintf("kismetdb version %d is newer than the newest supported version (%d). "+
+			"Please update kismetDataTool", version, MaxDBVersion))
+	}
+
+	return &KismetSchema{
+		Version:           version,
+		ScaledCoordinates: version < 5,
+		TimeUnit:          time.Second,
+		SubTimeUnit:       time.Microsecond,
+		tables:            kismetTables(),
+	}, nil
+}
+
+// Returns the layout of a table. Tables this package knows nothing about are returned with just
+// their name, so they can still be read as plain columns.
+func (schema *KismetSchema) Table(name string) TableSchema {
+	if table, ok := schema.tables[name]; ok {
+		return table
+	}
+	return TableSchema{Name: name}
+}
+
+// Returns the names of the tables this package knows about
+func (schema *KismetSchema) TableNames() []string {
+	return []string{"devices", "packets", "data", "alerts", "datasources", "messages", "snapshots"}
+}
+
+// Decodes a coordinate read from a column that holds coordinates. Kismet uses 0 for a missing
+// coordinate, so NULL becomes 0 too.
+func (schema *KismetSchema) Coordinate(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		if schema.ScaledCoordinates {
+			return float64(v) / coordinateScale, nil
+		}
+		return float64(v), nil
+	case float64:
+		if schema.ScaledCoordinates {
+			return v / coordinateScale, nil
+		}
+		return v, nil
+	default:
+		return 0, KismetDBError(fmt.Sprintf("%v is not a coordinate", v))
+	}
+}
+
+// Encodes a coordinate the way this version stores it, for use as a query parameter
+func (schema *KismetSchema) EncodeCoordinate(value float64) interface{} {
+	if schema.ScaledCoordinates {
+		return int64(value * coordinateScale)
+	}
+	return value
+}
+
+// Converts the value of timestamp columns into a time. sub may be nil for tables without a sub
+// second column.
+func (schema *KismetSchema) Timestamp(sec, sub interface{}) time.Time {
+	var whole, part int64
+	switch v := sec.(type) {
+	case int64:
+		whole = v
+	case float64:
+		whole = int64(v)
+	}
+	switch v := sub.(type) {
+	case int64:
+		part = v
+	case float64:
+		part = int64(v)
+	}
+	return time.Unix(0, 0).UTC().Add(time.Duration(whole)*schema.TimeUnit + time.Duration(part)*schema.SubTimeUnit)
+}
+
+// Converts a time into the value of a second based timestamp column
+func (schema *KismetSchema) EncodeTime(t time.Time) int64 {
+	return t.UnixNano() / int64(schema.TimeUnit)
+}
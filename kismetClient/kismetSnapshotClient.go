@@ -0,0 +1,73 @@
+package kismetClient
+
+// The KismetSnapshotClient reads the snapshots table of a kismetdb. Kismet periodically records
+// the state of the system and the GPS there. Each snapshot becomes one element with its record
+// as compact JSON text. The type of the snapshot takes the place of the ID.
+type KismetSnapshotClient struct {
+	tableClient
+}
+
+var snapshotHeaders = []string{
+	"lat", "lon", "snaptype", "timestamp", "json",
+}
+
+// Returns a generator of the snapshots in the database that match the filter
+func (client *KismetSnapshotClient) Elements() (func() (DataElement, error), error) {
+	badFunc := func() (DataElement, error) { return DataElement{}, KismetDBError("Generator not Initialized") }
+
+	if !client.Ready {
+		return badFunc, KismetDBError("DB Client is not ready!")
+	}
+
+	table := client.Schema.Table("snapshots")
+	client.query = &tableQuery{
+		db: client.db,
+		schema: client.Schema,
+		table: table,
+		columns: []string{table.Lat, table.Lon, table.Type, table.FirstTime, table.SubTime, table.JSON},
+		filter: client.Filter,
+	}
+
+	if err := client.query.run() ; err != nil {
+		return badFunc, err
+	}
+
+	return func() (DataElement, error) {
+		row, err := client.query.next()
+		if err != nil || row == nil {
+			return DataElement{}, err
+		}
+
+		record, err := decodeJSONRecord(row[table.JSON])
+		if err != nil {
+			return DataElement{}, err
+		}
+
+		return DataElement{
+			ID: row.string(table.Type),
+			Lat: row.coordinate(client.Schema, table.Lat),
+			Lon: row.coordinate(client.Schema, table.Lon),
+			data: []interface{}{
+				client.Schema.Timestamp(row[table.FirstTime], row[table.SubTime]),
+				jsonValue(record),
+			},
+			extraData: true,
+			HasData: true,
+		}, nil
+	}, nil
+}
+
+func (client *KismetSnapshotClient) ElementHeaders() []string {
+	return snapshotHeaders
+}
+
+// Returns a client for the snapshots table of the database. The client requires the Finish()
+// call to disconnect from the database when users are finished with it.
+func NewSnapshotClient(dbFile string) (KismetSnapshotClient, error) {
+	table, err := openTableClient(dbFile)
+	if err != nil {
+		return KismetSnapshotClient{}, err
+	}
+
+	return KismetSnapshotClient{tableClient: table}, nil
+}
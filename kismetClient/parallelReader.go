@@ -0,0 +1,257 @@
+package kismetClient
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+// How many shards each worker gets on average. More shards than workers keeps every worker busy
+// when the rowids are spread unevenly.
+const shardsPerWorker = 4
+
+// How many elements are handed from a worker to the generator at once
+const shardBatchSize = 256
+
+// How many batches each shard can have waiting for the generator
+const shardBuffer = 4
+
+// A shard is a range of rowids that one worker reads
+type shard struct {
+	first, last int64
+	// The elements read from the shard, when the order is kept
+	results chan shardBatch
+}
+
+type shardBatch struct {
+	elements []DataElement
+	err error
+}
+
+// Returns a generator that reads the table in rowid ranges with several connections at once.
+// Decoding a row costs more than reading it, so on large tables a single query keeps one core
+// busy while the rest of the machine waits. Each worker takes the next shard, reads it with its
+// own query, which database/sql runs on a connection of its own, and decodes the rows. Without
+// Ordered the elements are returned as the workers produce them. With Ordered the shards are
+// returned one after the other in rowid order, with the workers reading ahead.
+func (client *KismetDBClient) parallelElements(decoder *rowDecoder) (func() (DataElement, error), error) {
+	badFunc := func () (DataElement, error) { return DataElement{}, KismetDBError("Generator not Initialized") }
+
+	if !client.Ready {
+		return badFunc, KismetDBError("DB Client is not ready!")
+	}
+
+	table := client.Schema.Table(client.Table)
+	rowid, err := quoteIdentifier(table.Name)
+	if err != nil {
+		return badFunc, err
+	}
+	rowid += ".rowid"
+
+	// Check the query and read its column types without reading any rows
+	query, args, err := client.buildQuery("", "0", nil, "")
+	if err != nil {
+		return badFunc, err
+	}
+	if rows, err := client.db.Query(query, args...) ; err == nil {
+		columnTypes, err := rows.ColumnTypes()
+		rows.Close()
+		if err != nil {
+			return badFunc, KismetDBError(fmt.Sprint("Failed to read column types: ", err))
+		}
+
+		client.columnTypes = make([]string, len(decoder.names))
+		for i, v := range columnTypes {
+			client.columnTypes[i] = v.DatabaseTypeName()
+			if decoder.paths[i] != nil {
+				client.columnTypes[i] = "JSON"
+			}
+		}
+	} else {
+		return badFunc, KismetDBError(fmt.Sprintf("Failed to run kismet DB query: %v", err))
+	}
+
+	shards, err := client.shards(rowid)
+	if err != nil {
+		return badFunc, err
+	}
+
+	// The range of each shard is checked after the filter, so its bounds are the last arguments
+	query, args, err = client.buildQuery("", rowid + " between ? and ?", nil, " order by " + rowid)
+	if err != nil {
+		return badFunc, err
+	}
+
+	client.stop = make(chan struct{})
+	stop := client.stop
+
+	jobs := make(chan int, len(shards))
+	for i := range shards {
+		jobs <- i
+	}
+	close(jobs)
+
+	// Without the order, every worker sends to the same channel, which is closed once they are
+	// all done
+	var (
+		unordered chan shardBatch
+		workers sync.WaitGroup
+	)
+	if !client.Ordered {
+		unordered = make(chan shardBatch, shardBuffer * client.Workers)
+	}
+
+	for i := 0; i < client.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for v := range jobs {
+				results := unordered
+				if client.Ordered {
+					results = shards[v].results
+				}
+
+				shardArgs := append(append([]interface{}{}, args...), shards[v].first, shards[v].last)
+				ok := client.readShard(decoder, query, shardArgs, results, stop)
+				if client.Ordered {
+					close(results)
+				}
+				if !ok {
+					return
+				}
+			}
+		}()
+	}
+	if !client.Ordered {
+		go func() {
+			workers.Wait()
+			close(unordered)
+		}()
+	}
+
+	var (
+		batch []DataElement
+		current = 0
+	)
+
+	return func() (DataElement, error) {
+		for len(batch) == 0 {
+			results := unordered
+			if client.Ordered {
+				if current >= len(shards) {
+					return DataElement{}, nil // No more rows left
+				}
+				results = shards[current].results
+			}
+
+			next, open := <-results
+			if !open {
+				if !client.Ordered {
+					return DataElement{}, nil // No more rows left
+				}
+				current++
+				continue
+			}
+			if next.err != nil {
+				return DataElement{}, next.err
+			}
+			batch = next.elements
+		}
+
+		element := batch[0]
+		batch = batch[1:]
+		return element, nil
+	}, nil
+}
+
+// Splits the rowids of the table into ranges for the workers. The ranges cover the rowids the
+// table had when reading started, so rows added while the export runs are left out like they
+// would be by a single query.
+func (client *KismetDBClient) shards(rowid string) ([]shard, error) {
+	var (
+		first, last sql.NullInt64
+		shards []shard
+	)
+
+	quotedTable, _ := quoteIdentifier(client.Schema.Table(client.Table).Name)
+	if err := client.db.QueryRow(fmt.Sprintf("select min(%s), max(%s) from %s;", rowid, rowid, quotedTable)).Scan(&first, &last) ; err != nil {
+		return nil, KismetDBError(fmt.Sprint("Failed to read the rowids of ", client.Table, ": ", err))
+	} else if !first.Valid || !last.Valid {
+		return nil, nil // Empty table
+	}
+
+	count := int64(client.Workers * shardsPerWorker)
+	size := (last.Int64 - first.Int64 + count) / count
+	for start := first.Int64; start <= last.Int64; start += size {
+		end := start + size - 1
+		if end > last.Int64 {
+			end = last.Int64
+		}
+		shards = append(shards, shard{start, end, make(chan shardBatch, shardBuffer)})
+	}
+
+	return shards, nil
+}
+
+// Reads and decodes the rows of one shard, sending them in batches. Returns false if reading
+// failed or was stopped, in which case the worker gives up.
+func (client *KismetDBClient) readShard(decoder *rowDecoder, query string, args []interface{},
+	results chan shardBatch, stop chan struct{}) bool {
+	send := func(batch shardBatch) bool {
+		select {
+		case results <- batch:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+
+	rows, err := client.db.Query(query, args...)
+	if err != nil {
+		send(shardBatch{err: KismetDBError(fmt.Sprint("DB Query failed: ", err))})
+		return false
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		send(shardBatch{err: KismetDBError(fmt.Sprint("Failed to read the columns: ", err))})
+		return false
+	}
+	rowContent := make([]interface{}, len(columns))
+	for i := range columns {
+		rowContent[i] = scanTarget()
+	}
+
+	batch := make([]DataElement, 0, shardBatchSize)
+	for rows.Next() {
+		if err := rows.Scan(rowContent...) ; err != nil {
+			send(shardBatch{err: KismetDBError(fmt.Sprint("Failed to parse database: ", err))})
+			return false
+		}
+
+		element, err := decoder.decode(rowContent)
+		if err != nil {
+			send(shardBatch{err: err})
+			return false
+		}
+
+		batch = append(batch, element)
+		if len(batch) == shardBatchSize {
+			if !send(shardBatch{elements: batch}) {
+				return false
+			}
+			batch = make([]DataElement, 0, shardBatchSize)
+		}
+	}
+
+	if err := rows.Err() ; err != nil {
+		send(shardBatch{err: KismetDBError(fmt.Sprint("Failed to read from database: ", err))})
+		return false
+	}
+
+	if len(batch) > 0 {
+		return send(shardBatch{elements: batch})
+	}
+	return true
+}
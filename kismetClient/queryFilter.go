@@ -0,0 +1,217 @@
+package kismetClient
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A QueryFilter restricts which rows a DB client reads. The zero value matches every row. Each
+// field is turned into a predicate on the column that has that meaning in the table being read
+// (see TableSchema) and every value is passed to SQLite as a parameter, never as SQL.
+type QueryFilter struct {
+	// Only rows seen at or after Since
+	Since time.Time
+	// Only rows seen at or before Until
+	Until time.Time
+	// Only rows from this PHY, such as IEEE802.11
+	Phy string
+	// Only rows with a signal of at least this many dBm. Nil for any signal
+	MinSignal *int
+	// Only rows whose MAC address starts with this prefix, such as AA:BB:CC or aabbcc
+	MACPrefix string
+	// Only rows of this kind of device, such as Wi-Fi AP
+	DeviceType string
+	// Only rows captured by this datasource, given by its UUID or its name, such as wlan0
+	Datasource string
+	// Only rows located inside this area. Nil for anywhere
+	Area *BoundingBox
+	// Only rows involving one of these MAC addresses. Rows with several MAC addresses, such as
+	// packets, match if any of them is in the list
+	MACs []string
+}
+
+// An area between two latitudes and two longitudes, in degrees
+type BoundingBox struct {
+	MinLat, MinLon, MaxLat, MaxLon float64
+}
+
+// Returns true if the filter would match every row
+func (filter QueryFilter) IsEmpty() bool {
+	return filter.Since.IsZero() && filter.Until.IsZero() && filter.Phy == "" && filter.MinSignal == nil &&
+		filter.MACPrefix == "" && filter.DeviceType == "" && filter.Datasource == "" && filter.Area == nil &&
+		len(filter.MACs) == 0
+}
+
+// Builds the where clause for the filter on a table. Returns an empty clause if the filter
+// matches every row. Fails if the table has no column for something the filter asks for.
+func (filter QueryFilter) where(table TableSchema, schema *KismetSchema) (string, []interface{}, error) {
+	var (
+		predicates []string
+		args       []interface{}
+	)
+
+	// Adds a predicate on a column of the table. The predicate has the column substituted for %s
+	add := func(column, what, predicate string, values ...interface{}) error {
+		if column == "" {
+			return KismetDBError(fmt.Sprintf("The %s table has no %s to filter on", table.Name, what))
+		}
+
+		quoted, err := quoteIdentifier(column)
+		if err != nil {
+			return err
+		}
+
+		predicates = append(predicates, fmt.Sprintf(predicate, quoted))
+		args = append(args, values...)
+		return nil
+	}
+
+	// Rows overlap the time window when they were last seen after it started and first seen
+	// before it ended
+	if !filter.Since.IsZero() {
+		if err := add(table.LastTime, "time", "%s >= ?", schema.EncodeTime(filter.Since)); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if !filter.Until.IsZero() {
+		if err := add(table.FirstTime, "time", "%s <= ?", schema.EncodeTime(filter.Until)); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if filter.Phy != "" {
+		if err := add(table.Phy, "PHY", "%s = ? collate nocase", filter.Phy); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if filter.MinSignal != nil {
+		if err := add(table.Signal, "signal", "%s >= ?", *filter.MinSignal); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if filter.MACPrefix != "" {
+		pattern, err := macPrefixPattern(filter.MACPrefix)
+		if err != nil {
+			return "", nil, err
+		}
+
+		if err := add(table.MAC, "MAC address", "%s like ?", pattern); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if filter.DeviceType != "" {
+		if err := add(table.Type, "device type", "%s = ? collate nocase", filter.DeviceType); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if filter.Datasource != "" {
+		// Rows only record the UUID of the datasource. Names are looked up in the datasources table
+		sources, _ := quoteIdentifier(schema.Table("datasources").Name)
+		predicate := "%s in (select [uuid] from " + sources + " where [uuid] = ? collate nocase or [name] = ?)"
+		if err := add(table.Datasource, "datasource", predicate, filter.Datasource, filter.Datasource); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if filter.Area != nil {
+		area := filter.Area
+		if err := add(table.Lat, "location", "%s between ? and ?", schema.EncodeCoordinate(area.MinLat),
+			schema.EncodeCoordinate(area.MaxLat)); err != nil {
+			return "", nil, err
+		}
+		if err := add(table.Lon, "location", "%s between ? and ?", schema.EncodeCoordinate(area.MinLon),
+			schema.EncodeCoordinate(area.MaxLon)); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if len(filter.MACs) > 0 {
+		if table.MAC == "" {
+			return "", nil, KismetDBError(fmt.Sprintf("The %s table has no MAC address to filter on", table.Name))
+		}
+
+		macs := make([]interface{}, len(filter.MACs))
+		for i, v := range filter.MACs {
+			mac, err := NormalizeMAC(v)
+			if err != nil {
+				return "", nil, err
+			}
+			macs[i] = mac
+		}
+		list := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(macs)), ", ") + ")"
+
+		var matches []string
+		for _, v := range append([]string{table.MAC}, table.OtherMACs...) {
+			quoted, err := quoteIdentifier(v)
+			if err != nil {
+				return "", nil, err
+			}
+			matches = append(matches, quoted + " in " + list)
+			args = append(args, macs...)
+		}
+		predicates = append(predicates, "(" + strings.Join(matches, " or ") + ")")
+	}
+
+	if len(predicates) == 0 {
+		return "", nil, nil
+	}
+
+	return " where " + strings.Join(predicates, " and "), args, nil
+}
+
+var hexDigits = regexp.MustCompile("^[0-9a-fA-F]{1,12}$")
+
+// Turns a MAC address prefix in any of the usual notations into a LIKE pattern matching the
+// way Kismet stores MAC addresses (AA:BB:CC:DD:EE:FF). Only hex digits make it into the pattern,
+// so it can never contain wildcards of its own.
+func macPrefixPattern(prefix string) (string, error) {
+	digits := strings.NewReplacer(":", "", "-", "", ".", "").Replace(prefix)
+	if !hexDigits.MatchString(digits) {
+		return "", KismetDBError(fmt.Sprintf("%q is not a MAC address prefix", prefix))
+	}
+
+	var pattern strings.Builder
+	for i, c := range strings.ToUpper(digits) {
+		if i > 0 && i%2 == 0 {
+			pattern.WriteByte(':')
+		}
+		pattern.WriteRune(c)
+	}
+	pattern.WriteByte('%')
+
+	return pattern.String(), nil
+}
+
+var macDigits = regexp.MustCompile("^[0-9a-fA-F]{12}$")
+
+// Converts a MAC address in any of the usual notations into the way Kismet stores MAC addresses
+// (AA:BB:CC:DD:EE:FF)
+func NormalizeMAC(mac string) (string, error) {
+	digits := strings.NewReplacer(":", "", "-", "", ".", "").Replace(strings.TrimSpace(mac))
+	if !macDigits.MatchString(digits) {
+		return "", KismetDBError(fmt.Sprintf("%q is not a MAC address", mac))
+	}
+
+	pattern, err := macPrefixPattern(digits)
+	return strings.TrimSuffix(pattern, "%"), err
+}
+
+var identifierPattern = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// Table and column names can't be passed as parameters, so anything that names one must be a
+// plain identifier. It is quoted as well so that names that happen to be SQL keywords still work.
+// Brackets are used rather than double quotes, as SQLite reads a double quoted name that isn't a
+// column as a string, which would turn a missing column into a constant instead of an error.
+func quoteIdentifier(name string) (string, error) {
+	if !identifierPattern.MatchString(name) {
+		return "", KismetDBError(fmt.Sprintf("%q is not a valid table or column name", name))
+	}
+	return "[" + name + "]", nil
+}
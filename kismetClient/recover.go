@@ -0,0 +1,554 @@
+package kismetClient
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How many of the problems found by the integrity check are reported
+const maxRecoveryProblems = 100
+
+// Describes a kismetdb recovered by RecoverDB
+type RecoveryReport struct {
+	// The versions and the rows copied into each table of the recovered copy. The versions are
+	// empty if the KISMET table couldn't be read.
+	SubsetReport
+
+	// The size of the pages of the database, how many pages its header says it has and how many
+	// are actually in the file. A file that lost its end has fewer pages than its header says. When
+	// the size in the header isn't valid, the header is taken to have as many pages as the file.
+	PageSize int
+	HeaderPages, FilePages int64
+
+	// True if the database was left in the middle of a write with a journal that couldn't be
+	// rolled back, so the journal was left out
+	JournalDiscarded bool
+
+	// What SQLite's integrity check found wrong with the database, if anything
+	Problems []string
+
+	// The rows of each table that couldn't be read
+	Tables []TableRecovery
+}
+
+type TableRecovery struct {
+	Name string
+	// The ranges of rowids that couldn't be read. Rowids aren't always consecutive, so these are
+	// the most rows that could have been lost.
+	Lost []RowRange
+	// True if nothing after the last lost range could be read and the largest rowid of the table
+	// is unknown, so any number of rows may have been lost after it
+	LostEnd bool
+	// The error that stopped a table from being read at all
+	Err error
+}
+
+// Rowids from First to Last
+type RowRange struct {
+	First, Last int64
+}
+
+// Returns the most rows the table could have lost
+func (table TableRecovery) LostRows() int64 {
+	var lost int64
+	for _, v := range table.Lost {
+		lost += v.Last - v.First + 1
+	}
+	return lost
+}
+
+// Salvages every row that can still be read from a damaged kismetdb, such as one left behind by
+// a sensor that lost power, and writes them to a new database at dstFile. The source is never
+// written to. It is copied along with its journal, so that SQLite can finish rolling back an
+// interrupted write in the copy. dstFile must not exist yet.
+func RecoverDB(srcFile, dstFile string) (RecoveryReport, error) {
+	report := RecoveryReport{SubsetReport: SubsetReport{Rows: make(map[string]int64)}}
+
+	if info, err := os.Stat(srcFile) ; err != nil {
+		return report, KismetDBError(fmt.Sprintf("Can't read %s: %v", srcFile, err))
+	} else if info.IsDir() {
+		return report, KismetDBError(fmt.Sprintf("%s is a directory", srcFile))
+	}
+
+	if _, err := os.Stat(dstFile) ; err == nil {
+		return report, KismetDBError(fmt.Sprintf("%s already exists", dstFile))
+	}
+
+	workDir, err := ioutil.TempDir(filepath.Dir(dstFile), ".kismetDataTool-recover-")
+	if err != nil {
+		return report, KismetDBError(fmt.Sprint("Failed to create a working copy: ", err))
+	}
+	defer os.RemoveAll(workDir)
+
+	workFile := filepath.Join(workDir, "work.kismet")
+	for _, suffix := range []string{"", "-journal", "-wal"} {
+		if err := copyFile(srcFile + suffix, workFile + suffix) ; err != nil && !(suffix != "" && os.IsNotExist(err)) {
+			return report, KismetDBError(fmt.Sprint("Failed to create a working copy: ", err))
+		}
+	}
+
+	if report.PageSize, report.HeaderPages, report.FilePages, err = repairHeader(workFile) ; err != nil {
+		return report, err
+	}
+
+	pages := report.FilePages
+	if report.HeaderPages > pages {
+		pages = report.HeaderPages
+	}
+
+	src, lostEntries, err := openDamaged(workFile, pages)
+	if err != nil {
+		// The journal itself may be what is damaged. Without it the database is as it was before
+		// the interrupted write.
+		os.Remove(workFile + "-journal")
+		os.Remove(workFile + "-wal")
+		if src, lostEntries, err = openDamaged(workFile, pages) ; err != nil {
+			return report, KismetDBError(fmt.Sprintf("%s can't be recovered: %v", srcFile, err))
+		}
+		report.JournalDiscarded = true
+	}
+	defer src.Close()
+
+	if version, dbVersion, err := readKismetVersion(src) ; err == nil {
+		report.KismetVersion, report.DBVersion = version, dbVersion
+	}
+
+	report.Problems = integrityProblems(src)
+
+	dst, err := sql.Open("sqlite3", dstFile)
+	if err != nil {
+		return report, KismetDBError(fmt.Sprint("Failed to create DB connection", err))
+	}
+	defer dst.Close()
+
+	tx, err := dst.Begin()
+	if err != nil {
+		return report, KismetDBError(fmt.Sprint("Failed to write the copy: ", err))
+	}
+	defer tx.Rollback()
+
+	indexes, err := copySchema(src, tx)
+	if err != nil {
+		return report, err
+	}
+
+	// Tables whose root page is gone are kept in the copy, empty, so that it has the layout of a
+	// kismetdb
+	var lostTables []TableRecovery
+	for _, v := range lostEntries {
+		if v.objectType == "index" {
+			indexes = append(indexes, v.statement)
+		} else if _, err := tx.Exec(v.statement) ; err != nil {
+			return report, KismetDBError(fmt.Sprint("Failed to create a table: ", err))
+		} else {
+			report.Rows[v.name] = 0
+			lostTables = append(lostTables, TableRecovery{Name: v.name,
+				Err: KismetDBError("the page the table starts on was lost")})
+		}
+	}
+
+	names, err := tableNames(src)
+	if err != nil {
+		return report, err
+	}
+
+	for _, name := range names {
+		table := TableRecovery{Name: name}
+		report.Rows[name], table.Lost, table.LostEnd, table.Err = salvageTable(src, tx, name)
+		if _, isWriteError := table.Err.(recoveryWriteError) ; isWriteError {
+			return report, table.Err
+		}
+		report.Tables = append(report.Tables, table)
+	}
+	report.Tables = append(report.Tables, lostTables...)
+
+	for _, v := range indexes {
+		if _, err := tx.Exec(v) ; err != nil {
+			return report, KismetDBError(fmt.Sprint("Failed to create an index: ", err))
+		}
+	}
+
+	if err := tx.Commit() ; err != nil {
+		return report, KismetDBError(fmt.Sprint("Failed to write the copy: ", err))
+	}
+
+	return report, nil
+}
+
+// Failing to write the recovered copy stops the recovery, unlike failing to read the source
+type recoveryWriteError struct {
+	KismetDBError
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in) ; err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Reads the page size and page count from the header of a SQLite database and works out how
+// many pages the file actually holds. The page count in the header is only used when SQLite
+// would use it too. A file that lost its end is filled back up to the pages its
+// header says it has with zeros, as is a page that was only partly written. The tables whose root
+// page was lost then point at an empty page, which fails when the table is read, instead of past
+// the end of the file, which stops SQLite from reading the schema at all.
+func repairHeader(file string) (int, int64, int64, error) {
+	handle, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return 0, 0, 0, KismetDBError(fmt.Sprintf("Can't read %s: %v", file, err))
+	}
+	defer handle.Close()
+
+	header := make([]byte, 100)
+	if _, err := io.ReadFull(handle, header) ; err != nil || !strings.HasPrefix(string(header), "SQLite format 3\x00") {
+		return 0, 0, 0, KismetDBError("The file is not a SQLite database, or lost its header")
+	}
+
+	pageSize := int(binary.BigEndian.Uint16(header[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+
+	info, err := handle.Stat()
+	if err != nil {
+		return 0, 0, 0, KismetDBError(fmt.Sprintf("Can't read %s: %v", file, err))
+	}
+
+	filePages := (info.Size() + int64(pageSize) - 1) / int64(pageSize)
+
+	// Like SQLite, only trust the size in the header when it was written by the same change as
+	// the rest of the header. Older versions of SQLite didn't keep it up to date.
+	headerPages := int64(binary.BigEndian.Uint32(header[28:32]))
+	if headerPages == 0 || !bytes.Equal(header[24:28], header[92:96]) {
+		headerPages = filePages
+	}
+
+	pages := filePages
+	if headerPages > pages {
+		pages = headerPages
+	}
+	if info.Size() != pages * int64(pageSize) {
+		if err := handle.Truncate(pages * int64(pageSize)) ; err != nil {
+			return 0, 0, 0, KismetDBError(fmt.Sprint("Failed to repair the working copy: ", err))
+		}
+	}
+
+	return pageSize, headerPages, filePages, nil
+}
+
+// Opens a database that may be damaged. The working copy is opened for writing so that SQLite
+// can roll back an interrupted write. If SQLite can't read its schema, the tables and indexes
+// whose root page is gone are taken out of it and returned.
+func openDamaged(file string, pages int64) (*sql.DB, []schemaEntry, error) {
+	db, err := openWorkingCopy(file)
+	if err == nil {
+		return db, nil, nil
+	}
+
+	lost, dropErr := dropLostRoots(file, pages)
+	if dropErr != nil || len(lost) == 0 {
+		return nil, nil, err
+	}
+
+	if db, err = openWorkingCopy(file) ; err != nil {
+		return nil, nil, err
+	}
+	return db, lost, nil
+}
+
+func openWorkingCopy(file string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=%d", dsnPath(file),
+		busyTimeout.Nanoseconds() / int64(time.Millisecond)))
+	if err != nil {
+		return nil, err
+	}
+
+	var tables int
+	if err := db.QueryRow("select count(*) from sqlite_master;").Scan(&tables) ; err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// A table or index from the schema of a database
+type schemaEntry struct {
+	objectType, name, statement string
+}
+
+// Takes the tables and indexes whose root page isn't in the file out of the schema of the working
+// copy, returning them. SQLite refuses to read any of a database with such an entry unless its
+// schema is writable, and the driver only makes it writable after it has read the schema, so the
+// working copy is attached to a connection that already has writable_schema on.
+func dropLostRoots(file string, pages int64) ([]schemaEntry, error) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	// The pragma and the attached database belong to the connection
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec("pragma writable_schema=on;") ; err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("attach database ? as damaged;", file) ; err != nil {
+		return nil, err
+	}
+
+	const lostRoot = "from damaged.sqlite_master where type in ('table', 'index') and (rootpage < 2 or rootpage > ?)"
+
+	rows, err := db.Query("select type, name, sql " + lostRoot + " order by rowid;", pages)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lost []schemaEntry
+	for rows.Next() {
+		var (
+			entry schemaEntry
+			statement sql.NullString
+		)
+		if err := rows.Scan(&entry.objectType, &entry.name, &statement) ; err != nil {
+			return nil, err
+		}
+		// Indexes SQLite creates for UNIQUE constraints have no statement and come back with
+		// their table
+		if statement.Valid {
+			entry.statement = statement.String
+			lost = append(lost, entry)
+		}
+	}
+	if err := rows.Err() ; err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if _, err := db.Exec("delete " + lostRoot + ";", pages) ; err != nil {
+		return nil, err
+	}
+
+	return lost, nil
+}
+
+// Runs SQLite's integrity check, returning what it found wrong
+func integrityProblems(db *sql.DB) []string {
+	rows, err := db.Query(fmt.Sprintf("pragma integrity_check(%d);", maxRecoveryProblems))
+	if err != nil {
+		return []string{err.Error()}
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var problem string
+		if err := rows.Scan(&problem) ; err != nil {
+			return append(problems, err.Error())
+		}
+		// Problems can span several lines, which start with the database they were found in
+		for _, v := range strings.Split(problem, "\n") {
+			if v != "ok" && !strings.HasPrefix(v, "*** in database") {
+				problems = append(problems, v)
+			}
+		}
+	}
+	if err := rows.Err() ; err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	return problems
+}
+
+// Lists the tables of the database, whatever they are
+func tableNames(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("select name from sqlite_master where type = 'table' and name not like 'sqlite_%' order by rowid;")
+	if err != nil {
+		return nil, KismetDBError(fmt.Sprint("Failed to list the tables: ", err))
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name) ; err != nil {
+			return nil, KismetDBError(fmt.Sprint("Failed to list the tables: ", err))
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
+// Copies every row of a table that can be read. Rows are read in rowid order, and when reading
+// fails the rows are probed by rowid to find the next one that can be read, skipping the damaged
+// pages. Returns the rows copied, the rowids that were skipped and whether the end of the table
+// is unknown.
+func salvageTable(src *sql.DB, tx *sql.Tx, name string) (int64, []RowRange, bool, error) {
+	quotedTable, err := quoteIdentifier(name)
+	if err != nil {
+		return 0, nil, false, err
+	}
+
+	columns, err := tableColumns(src, name)
+	if err != nil {
+		return 0, nil, false, err
+	}
+
+	quotedColumns := make([]string, len(columns))
+	for i, v := range columns {
+		if quotedColumns[i], err = quoteIdentifier(v) ; err != nil {
+			return 0, nil, false, err
+		}
+	}
+
+	insert, err := tx.Prepare("insert into " + quotedTable + " (" + strings.Join(quotedColumns, ", ") + ") values (" +
+		strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ") + ");")
+	if err != nil {
+		return 0, nil, false, recoveryWriteError{KismetDBError(fmt.Sprint("Failed to write ", name, ": ", err))}
+	}
+	defer insert.Close()
+
+	var (
+		copied int64
+		lost []RowRange
+		next int64 = math.MinInt64
+		selectRows = "select rowid, " + strings.Join(quotedColumns, ", ") + " from " + quotedTable +
+			" where rowid >= ? order by rowid;"
+	)
+
+	for {
+		last, count, err := copyReadable(src, insert, selectRows, next, len(columns))
+		copied += count
+		if err == nil {
+			return copied, lost, false, nil
+		} else if _, isWriteError := err.(recoveryWriteError) ; isWriteError {
+			return copied, lost, false, err
+		}
+
+		// The first row that couldn't be read
+		failed := next
+		if count > 0 {
+			failed = last + 1
+		} else if next == math.MinInt64 {
+			// Nothing has been read yet. Rowids start at 1 unless the table says otherwise.
+			failed = 1
+			var smallest sql.NullInt64
+			if src.QueryRow("select min(rowid) from " + quotedTable + ";").Scan(&smallest) == nil && smallest.Valid {
+				failed = smallest.Int64
+			}
+		}
+
+		resume, found := nextReadableRow(src, quotedTable, failed)
+		if !found {
+			// Nothing after the damage can be read. The largest rowid may still be known.
+			var largest sql.NullInt64
+			if src.QueryRow("select max(rowid) from " + quotedTable + ";").Scan(&largest) == nil && largest.Valid &&
+				largest.Int64 >= failed {
+				return copied, append(lost, RowRange{failed, largest.Int64}), false, nil
+			}
+			return copied, append(lost, RowRange{failed, failed}), true, nil
+		}
+
+		lost = append(lost, RowRange{failed, resume - 1})
+		next = resume
+	}
+}
+
+// Copies rows in rowid order from the rowid next onwards until the end of the table or a row
+// that can't be read. Returns the rowid of the last row copied and how many were copied.
+func copyReadable(src *sql.DB, insert *sql.Stmt, selectRows string, next int64, columns int) (int64, int64, error) {
+	var (
+		last, copied int64
+		rowid int64
+		values = make([]interface{}, columns)
+		targets = make([]interface{}, columns + 1)
+	)
+	targets[0] = &rowid
+	for i := range values {
+		targets[i + 1] = &values[i]
+	}
+
+	rows, err := src.Query(selectRows, next)
+	if err != nil {
+		return last, copied, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := rows.Scan(targets...) ; err != nil {
+			return last, copied, err
+		}
+		if _, err := insert.Exec(values...) ; err != nil {
+			return last, copied, recoveryWriteError{KismetDBError(fmt.Sprint("Failed to write a recovered row: ", err))}
+		}
+		last = rowid
+		copied++
+	}
+
+	return last, copied, rows.Err()
+}
+
+// Finds the first row after failed that can be read. Looking up a rowid only reads the pages on
+// the way to it, so lookups can get past damaged pages that a scan can't. Lookups jump ahead
+// further each time until one works, then close back in on the first row that can be read.
+func nextReadableRow(src *sql.DB, quotedTable string, failed int64) (int64, bool) {
+	lookup := func(from int64) (int64, bool) {
+		var rowid int64
+		err := src.QueryRow("select rowid from " + quotedTable + " where rowid >= ? order by rowid limit 1;", from).Scan(&rowid)
+		return rowid, err == nil
+	}
+
+	var (
+		low = failed // The furthest lookup known to fail
+		high int64
+		resume int64
+		found = false
+	)
+
+	for step := int64(1) ; step > 0 && failed <= math.MaxInt64 - step ; step *= 2 {
+		if rowid, ok := lookup(failed + step) ; ok {
+			high, resume, found = failed + step, rowid, true
+			break
+		}
+		low = failed + step
+	}
+
+	if !found {
+		return 0, false
+	}
+
+	for high - low > 1 {
+		middle := low + (high - low) / 2
+		if rowid, ok := lookup(middle) ; ok {
+			high, resume = middle, rowid
+		} else {
+			low = middle
+		}
+	}
+
+	return resume, true
+}
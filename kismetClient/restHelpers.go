@@ -8,10 +8,12 @@ func (err KismetRestError) Error() string {
 	return string(err)
 }
 
+// Cancels the requests of the client that are still in flight, including those of copies of the
+// client and of the clients built on it. Later requests fail. Finish() can be called from another
+// goroutine while a request is made, so it leaves Ready alone.
 func (client *KismetRestClient) Finish() error {
-	if request != nil {
-		request.Body.Close()
+	if client.finish != nil {
+		client.finish.Do(func() { close(client.done) })
 	}
-	client.Ready = false
 	return nil
 }
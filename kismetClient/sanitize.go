@@ -0,0 +1,412 @@
+package kismetClient
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Every table a sanitized copy has rows in. Tables this package doesn't know about are created
+// but left empty, as there is no telling what they hold.
+var sanitizeTables = []string{"KISMET", "datasources", "devices", "packets", "alerts", "data", "messages", "snapshots"}
+
+// Link types whose headers are kept when the payloads are dropped
+const (
+	dltIEEE80211 = 105
+	dltRadiotap = 127
+)
+
+// SSIDs shorter than this aren't replaced in free text, where they would match inside words
+const minTextSSID = 3
+
+// How a sanitized copy is written
+type Sanitizer struct {
+	// The secret key of the keyed hash the pseudonyms are made with. The same key always gives
+	// the same pseudonyms, so copies sanitized with one key can still be compared with each other.
+	// Nobody without the key can tell which address or SSID a pseudonym stands for.
+	Key []byte
+	// Round coordinates to this many decimal places. Negative keeps them as they are
+	Precision int
+}
+
+var (
+	macPattern = regexp.MustCompile("^[0-9A-Fa-f]{2}(:[0-9A-Fa-f]{2}){5}$")
+	macInText = regexp.MustCompile("\\b[0-9A-Fa-f]{2}(:[0-9A-Fa-f]{2}){5}\\b")
+	// Kismet device keys end with the MAC address of the device, such as 4202770D00000000_AABBCC000000
+	devKeyPattern = regexp.MustCompile("^([0-9A-Fa-f]{16})_([0-9A-Fa-f]{12})$")
+)
+
+// Writes a copy of a kismetdb that can be shared. MAC addresses and SSIDs are replaced by
+// pseudonyms everywhere, including inside the JSON records, and the contents of packets are
+// dropped. 802.11 packets keep their radiotap and MAC headers. dstFile must not exist yet.
+func WriteSanitized(srcFile, dstFile string, sanitizer Sanitizer) (SubsetReport, error) {
+	if len(sanitizer.Key) == 0 {
+		return SubsetReport{}, KismetDBError("Sanitizing needs a key")
+	}
+
+	state := sanitizeState{Sanitizer: sanitizer, ssids: make(map[string]string)}
+	return writeCopy(srcFile, dstFile, sanitizeTables, QueryFilter{}, state.sanitizeRow)
+}
+
+// The pseudonyms handed out while writing a sanitized copy
+type sanitizeState struct {
+	Sanitizer
+	// The pseudonym of every SSID met so far, to replace them in free text such as messages
+	ssids map[string]string
+	// Replaces the SSIDs in free text. Built again when new SSIDs are met
+	ssidReplacer *strings.Replacer
+}
+
+func (state *sanitizeState) sanitizeRow(schema *KismetSchema, name string, columns []string, values []interface{}) error {
+	table := schema.Table(name)
+
+	index := make(map[string]int, len(columns))
+	for i, v := range columns {
+		index[v] = i
+	}
+
+	for i, column := range columns {
+		switch {
+		case column == table.JSON && column != "":
+			sanitized, err := state.sanitizeRecord(values[i])
+			if err != nil {
+				return KismetDBError(fmt.Sprint("Failed to sanitize ", name, ": ", err))
+			}
+			values[i] = sanitized
+		case name == "packets" && column == "packet":
+			// Done below, once the other columns are known
+		case name == "messages" && column == "message":
+			if text, ok := values[i].(string) ; ok {
+				values[i] = state.freeText(text)
+			}
+		case table.IsCoordinate(column) && column != table.Alt:
+			coarsened, err := state.coarsen(schema, values[i])
+			if err != nil {
+				return err
+			}
+			values[i] = coarsened
+		default:
+			if text, ok := values[i].(string) ; ok {
+				values[i] = state.identifier(text)
+			}
+		}
+	}
+
+	if name == "packets" {
+		if i, ok := index["packet"] ; ok {
+			state.sanitizePacket(values, index, i)
+		}
+	}
+
+	return nil
+}
+
+// Drops the contents of a packet, keeping the headers of 802.11 frames. The lengths are changed
+// to match, with the length of the whole packet kept where the database has a column for it.
+func (state *sanitizeState) sanitizePacket(values []interface{}, index map[string]int, packetColumn int) {
+	data, _ := values[packetColumn].([]byte)
+
+	var dlt int64
+	if i, ok := index["dlt"] ; ok {
+		dlt, _ = values[i].(int64)
+	}
+
+	headers := state.packetHeaders(dlt, data)
+	values[packetColumn] = headers
+
+	if i, ok := index["packet_full_len"] ; ok {
+		if full, _ := values[i].(int64) ; full < int64(len(data)) {
+			values[i] = int64(len(data))
+		}
+	}
+	if i, ok := index["packet_len"] ; ok {
+		values[i] = int64(len(headers))
+	}
+}
+
+// Returns the radiotap and 802.11 MAC headers of a packet, with the addresses in the MAC header
+// replaced. Packets of other link types, and packets too short to hold their headers, keep nothing.
+func (state *sanitizeState) packetHeaders(dlt int64, data []byte) []byte {
+	offset := 0
+	switch dlt {
+	case dltRadiotap:
+		if len(data) < 4 {
+			return []byte{}
+		}
+		offset = int(binary.LittleEndian.Uint16(data[2:4]))
+	case dltIEEE80211:
+	default:
+		return []byte{}
+	}
+
+	if len(data) < offset + 10 {
+		return []byte{}
+	}
+
+	frame := data[offset:]
+	length := ieee80211HeaderLength(frame)
+	if len(frame) < length {
+		return []byte{}
+	}
+
+	headers := make([]byte, offset + length)
+	copy(headers, data)
+
+	// The addresses are at 4, 10, 16 and, in data frames between access points, 24
+	positions := []int{4, 10, 16}
+	if (frame[0] >> 2) & 0x3 == 2 && frame[1] & 0x3 == 0x3 {
+		positions = append(positions, 24)
+	}
+	for _, v := range positions {
+		if v + 6 > length {
+			break
+		}
+
+		address, _ := hex.DecodeString(strings.Replace(state.mac(formatMAC(frame[v:v + 6])), ":", "", -1))
+		copy(headers[offset + v:], address)
+	}
+
+	return headers
+}
+
+// Returns how long the MAC header of an 802.11 frame is, going by its frame control field
+func ieee80211HeaderLength(frame []byte) int {
+	frameType := (frame[0] >> 2) & 0x3
+	subtype := (frame[0] >> 4) & 0xF
+	flags := frame[1]
+
+	if frameType == 1 { // Control frames
+		if subtype == 7 || subtype == 12 || subtype == 13 { // Control wrapper, CTS and ACK
+			return 10
+		}
+		return 16
+	}
+
+	length := 24
+	if frameType == 2 && flags & 0x3 == 0x3 { // Between access points
+		length += 6
+	}
+	if frameType == 2 && subtype & 0x8 != 0 { // QoS data
+		length += 2
+		if flags & 0x80 != 0 { // HT control
+			length += 4
+		}
+	} else if frameType == 0 && flags & 0x80 != 0 {
+		length += 4
+	}
+
+	return length
+}
+
+func formatMAC(address []byte) string {
+	octets := make([]string, len(address))
+	for i, v := range address {
+		octets[i] = fmt.Sprintf("%02X", v)
+	}
+	return strings.Join(octets, ":")
+}
+
+// Returns the keyed hash of a value. kind keeps equal values of different kinds apart.
+func (state *sanitizeState) hash(kind, value string) []byte {
+	mac := hmac.New(sha256.New, state.Key)
+	mac.Write([]byte(kind + ":" + value))
+	return mac.Sum(nil)
+}
+
+// Returns the pseudonym of a MAC address. Pseudonyms are locally administered addresses so they
+// can't be mistaken for a real vendor. Broadcast, multicast and empty addresses don't identify
+// a device and are kept.
+func (state *sanitizeState) mac(mac string) string {
+	normalized := strings.ToUpper(mac)
+	if normalized == "00:00:00:00:00:00" {
+		return normalized
+	}
+
+	if first, err := hex.DecodeString(normalized[:2]) ; err != nil || first[0] & 0x01 != 0 {
+		return normalized
+	}
+
+	sum := state.hash("mac", normalized)
+	sum[0] = sum[0] &^ 0x01 | 0x02
+	return formatMAC(sum[:6])
+}
+
+// Returns the pseudonym of an SSID or device name. Hidden networks keep their empty SSID.
+func (state *sanitizeState) ssid(ssid string) string {
+	if ssid == "" {
+		return ssid
+	}
+
+	if pseudonym, ok := state.ssids[ssid] ; ok {
+		return pseudonym
+	}
+
+	pseudonym := "ssid-" + hex.EncodeToString(state.hash("ssid", ssid)[:6])
+	state.ssids[ssid] = pseudonym
+	state.ssidReplacer = nil
+	return pseudonym
+}
+
+// Replaces a value that is a MAC address or a device key, leaving anything else alone
+func (state *sanitizeState) identifier(value string) string {
+	if macPattern.MatchString(value) {
+		return state.mac(value)
+	} else if parts := devKeyPattern.FindStringSubmatch(value) ; parts != nil {
+		mac := state.mac(formatMACDigits(parts[2]))
+		return parts[1] + "_" + strings.Replace(mac, ":", "", -1)
+	}
+	return value
+}
+
+func formatMACDigits(digits string) string {
+	octets := make([]string, 0, 6)
+	for i := 0 ; i + 2 <= len(digits) ; i += 2 {
+		octets = append(octets, digits[i:i + 2])
+	}
+	return strings.Join(octets, ":")
+}
+
+// Replaces the MAC addresses and the SSIDs met so far in text written for people, such as alerts
+// and messages
+func (state *sanitizeState) freeText(text string) string {
+	text = macInText.ReplaceAllStringFunc(text, state.mac)
+
+	if state.ssidReplacer == nil {
+		ssids := make([]string, 0, len(state.ssids))
+		for ssid := range state.ssids {
+			if len(ssid) >= minTextSSID {
+				ssids = append(ssids, ssid)
+			}
+		}
+		// The longest SSIDs go first, so an SSID inside another one doesn't win
+		sort.Slice(ssids, func(i, j int) bool { return len(ssids[i]) > len(ssids[j]) })
+
+		pairs := make([]string, 0, len(ssids) * 2)
+		for _, v := range ssids {
+			pairs = append(pairs, v, state.ssids[v])
+		}
+		state.ssidReplacer = strings.NewReplacer(pairs...)
+	}
+
+	return state.ssidReplacer.Replace(text)
+}
+
+// Rounds a coordinate column to the precision of the sanitizer
+func (state *sanitizeState) coarsen(schema *KismetSchema, value interface{}) (interface{}, error) {
+	if state.Precision < 0 || value == nil {
+		return value, nil
+	}
+
+	coordinate, err := schema.Coordinate(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return schema.EncodeCoordinate(state.round(coordinate)), nil
+}
+
+func (state *sanitizeState) round(coordinate float64) float64 {
+	scale := math.Pow(10, float64(state.Precision))
+	return math.Round(coordinate * scale) / scale
+}
+
+// Sanitizes a JSON record, returning it as the same type it was stored as
+func (state *sanitizeState) sanitizeRecord(value interface{}) (interface{}, error) {
+	record, err := decodeJSONRecord(value)
+	if err != nil || record == nil {
+		return value, err
+	}
+
+	var encoded bytes.Buffer
+	encoder := json.NewEncoder(&encoded)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(state.sanitizeField("", record)) ; err != nil {
+		return nil, err
+	}
+	raw := bytes.TrimSuffix(encoded.Bytes(), []byte("\n"))
+
+	if _, isText := value.(string) ; isText {
+		return string(raw), nil
+	}
+	return raw, nil
+}
+
+// Sanitizes a field of a JSON record and everything below it. key is the name of the field.
+func (state *sanitizeState) sanitizeField(key string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		// Some records are keyed by MAC address, such as the clients of an access point
+		fields := make(map[string]interface{}, len(v))
+		for name, field := range v {
+			fields[state.identifier(name)] = state.sanitizeField(name, field)
+		}
+		return fields
+	case []interface{}:
+		for i, element := range v {
+			if isLocationField(key, "geopoint") {
+				v[i] = state.coarsenField(element)
+			} else {
+				v[i] = state.sanitizeField(key, element)
+			}
+		}
+		return v
+	case string:
+		if macPattern.MatchString(v) || devKeyPattern.MatchString(v) {
+			return state.identifier(v)
+		} else if isNameField(key) {
+			return state.ssid(v)
+		} else if strings.HasSuffix(key, ".text") {
+			return state.freeText(v)
+		}
+		return v
+	case json.Number:
+		if isLocationField(key, "lat") || isLocationField(key, "lon") {
+			return state.coarsenField(v)
+		} else if strings.HasSuffix(key, "ssid_hash") {
+			// Hashes of SSIDs can be matched against a list of SSIDs
+			return json.Number(fmt.Sprint(binary.BigEndian.Uint32(state.hash("ssid_hash", v.String()))))
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func (state *sanitizeState) coarsenField(value interface{}) interface{} {
+	number, ok := value.(json.Number)
+	if !ok || state.Precision < 0 {
+		return value
+	}
+
+	if coordinate, err := number.Float64() ; err == nil {
+		return state.round(coordinate)
+	}
+	return value
+}
+
+// Returns true for the fields of Kismet location records, such as kismet.common.location.lat
+func isLocationField(key, field string) bool {
+	return strings.HasPrefix(key, "kismet.common.location.") && strings.HasSuffix(key, "." + field)
+}
+
+// Returns true for fields holding an SSID or a name someone gave a device
+func isNameField(key string) bool {
+	if strings.HasPrefix(key, "kismet.datasource.") {
+		return false // Names of the datasources, which the datasources table has too
+	}
+
+	field := key[strings.LastIndex(key, ".") + 1:]
+	switch field {
+	case "name", "commonname", "username", "wps_device_name", "wps_serial_number":
+		return true
+	}
+	return strings.HasSuffix(field, "ssid")
+}
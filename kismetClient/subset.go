@@ -0,0 +1,202 @@
+package kismetClient
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The tables whose rows are filtered when writing a subset. The datasources and the KISMET
+// table are copied whole so that Kismet can load the subset. The rows of every other table,
+// such as messages and snapshots, are left out as they can't be narrowed down to the devices.
+var subsetTables = []string{"devices", "packets", "alerts", "data"}
+
+// Describes a copy of a kismetdb written by WriteSubset or WriteSanitized
+type SubsetReport struct {
+	// The contents of the KISMET table of the source, which the copy has too
+	KismetVersion string
+	DBVersion int
+	// How many rows were copied into each table
+	Rows map[string]int64
+}
+
+// Changes the values of a row as it is copied. columns holds the names of the values.
+type rowTransform func(schema *KismetSchema, table string, columns []string, values []interface{}) error
+
+// Writes a new kismetdb to dstFile holding only the rows of the source that match the filter. The
+// new database has the same layout and KISMET table as the source, so Kismet can load it. dstFile
+// must not exist yet.
+func WriteSubset(srcFile, dstFile string, filter QueryFilter) (SubsetReport, error) {
+	tables := append([]string{"KISMET", "datasources"}, subsetTables...)
+	return writeCopy(srcFile, dstFile, tables, filter, nil)
+}
+
+// Copies the rows of the tables to a new kismetdb. Only the tables in subsetTables are filtered,
+// the others are copied whole. transform may be nil to copy the rows as they are.
+func writeCopy(srcFile, dstFile string, tables []string, filter QueryFilter, transform rowTransform) (SubsetReport, error) {
+	src, kismetVersion, dbVersion, schema, err := openKismetDB(srcFile)
+	if err != nil {
+		return SubsetReport{}, err
+	}
+	defer src.Close()
+
+	if _, err := os.Stat(dstFile) ; err == nil {
+		return SubsetReport{}, KismetDBError(fmt.Sprintf("%s already exists", dstFile))
+	}
+
+	dst, err := sql.Open("sqlite3", dstFile)
+	if err != nil {
+		return SubsetReport{}, KismetDBError(fmt.Sprint("Failed to create DB connection", err))
+	}
+	defer dst.Close()
+
+	// Everything is written in one transaction, which is much quicker than a transaction for every
+	// row. Anything going wrong leaves a file that the caller has to throw away.
+	tx, err := dst.Begin()
+	if err != nil {
+		return SubsetReport{}, KismetDBError(fmt.Sprint("Failed to write the copy: ", err))
+	}
+	defer tx.Rollback()
+
+	indexes, err := copySchema(src, tx)
+	if err != nil {
+		return SubsetReport{}, err
+	}
+
+	copied := make(map[string]int64)
+	filtered := make(map[string]bool)
+	for _, v := range subsetTables {
+		filtered[v] = true
+	}
+
+	for _, name := range tables {
+		reports, err := tableColumnReports(src, name)
+		if err != nil {
+			return SubsetReport{}, err
+		} else if len(reports) == 0 {
+			continue // Older databases don't have every table
+		}
+
+		columns := make([]string, len(reports))
+		for i, v := range reports {
+			columns[i] = v.Name
+		}
+
+		rowFilter := QueryFilter{}
+		if filtered[name] {
+			rowFilter = filter
+		}
+
+		if copied[name], err = copyRows(src, tx, schema, name, columns, rowFilter, transform) ; err != nil {
+			return SubsetReport{}, err
+		}
+	}
+
+	// Indexes are quicker to build once the rows are in
+	for _, v := range indexes {
+		if _, err := tx.Exec(v) ; err != nil {
+			return SubsetReport{}, KismetDBError(fmt.Sprint("Failed to create an index: ", err))
+		}
+	}
+
+	if err := tx.Commit() ; err != nil {
+		return SubsetReport{}, KismetDBError(fmt.Sprint("Failed to write the copy: ", err))
+	}
+
+	return SubsetReport{kismetVersion, dbVersion, copied}, nil
+}
+
+// Creates the tables of the source in the transaction, using the statements the source was
+// created with. Returns the statements that create the indexes.
+func copySchema(src *sql.DB, tx *sql.Tx) ([]string, error) {
+	rows, err := src.Query("select type, sql from sqlite_master where sql is not null and name not like 'sqlite_%' " +
+		"order by type = 'index', rowid;")
+	if err != nil {
+		return nil, KismetDBError(fmt.Sprint("Failed to read the layout of the database: ", err))
+	}
+	defer rows.Close()
+
+	var indexes []string
+	for rows.Next() {
+		var objectType, statement string
+		if err := rows.Scan(&objectType, &statement) ; err != nil {
+			return nil, KismetDBError(fmt.Sprint("Failed to read the layout of the database: ", err))
+		}
+
+		if objectType == "index" {
+			indexes = append(indexes, statement)
+		} else if objectType == "table" {
+			if _, err := tx.Exec(statement) ; err != nil {
+				return nil, KismetDBError(fmt.Sprint("Failed to create a table: ", err))
+			}
+		}
+		// Views and triggers aren't part of a kismetdb
+	}
+
+	return indexes, rows.Err()
+}
+
+// Copies the rows of a table that match the filter, passing each through the transform if there
+// is one
+func copyRows(src *sql.DB, tx *sql.Tx, schema *KismetSchema, name string, columns []string, filter QueryFilter,
+	transform rowTransform) (int64, error) {
+	quotedTable, err := quoteIdentifier(name)
+	if err != nil {
+		return 0, err
+	}
+
+	quotedColumns := make([]string, len(columns))
+	for i, v := range columns {
+		if quotedColumns[i], err = quoteIdentifier(v) ; err != nil {
+			return 0, err
+		}
+	}
+
+	where, args, err := filter.where(schema.Table(name), schema)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := src.Query("select " + strings.Join(quotedColumns, ", ") + " from " + quotedTable + where + ";", args...)
+	if err != nil {
+		return 0, KismetDBError(fmt.Sprint("Failed to read ", name, ": ", err))
+	}
+	defer rows.Close()
+
+	insert, err := tx.Prepare("insert into " + quotedTable + " (" + strings.Join(quotedColumns, ", ") + ") values (" +
+		strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ") + ");")
+	if err != nil {
+		return 0, KismetDBError(fmt.Sprint("Failed to write ", name, ": ", err))
+	}
+	defer insert.Close()
+
+	// Values are copied without converting them, so they are stored exactly as in the source unless
+	// the transform changes them
+	values := make([]interface{}, len(columns))
+	targets := make([]interface{}, len(columns))
+	for i := range values {
+		targets[i] = &values[i]
+	}
+
+	var copied int64
+	for rows.Next() {
+		if err := rows.Scan(targets...) ; err != nil {
+			return copied, KismetDBError(fmt.Sprint("Failed to read ", name, ": ", err))
+		}
+		if transform != nil {
+			if err := transform(schema, name, columns, values) ; err != nil {
+				return copied, err
+			}
+		}
+		if _, err := insert.Exec(values...) ; err != nil {
+			return copied, KismetDBError(fmt.Sprint("Failed to write ", name, ": ", err))
+		}
+		copied++
+	}
+
+	if err := rows.Err() ; err != nil {
+		return copied, KismetDBError(fmt.Sprint("Failed to read ", name, ": ", err))
+	}
+	return copied, nil
+}
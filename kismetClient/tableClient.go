@@ -0,0 +1,52 @@
+package kismetClient
+
+import (
+	"database/sql"
+)
+
+// The parts that the clients of the kismetdb tables have in common. Each client embeds one and
+// reads its table with the query.
+type tableClient struct {
+	db *sql.DB
+	query *tableQuery
+
+	// The contents of the KISMET table of the database
+	KismetVersion string
+	DBVersion int
+	// How this version of the database stores its data
+	Schema *KismetSchema
+
+	// Restricts the rows that are read. Set before calling Elements()
+	Filter QueryFilter
+
+	Ready bool
+}
+
+// Opens the database for a table client
+func openTableClient(dbFile string) (tableClient, error) {
+	db, kismetVersion, dbVersion, schema, err := openKismetDB(dbFile)
+	if err != nil {
+		return tableClient{}, err
+	}
+
+	return tableClient{
+		db: db,
+		KismetVersion: kismetVersion,
+		DBVersion: dbVersion,
+		Schema: schema,
+		Ready: true,
+	}, nil
+}
+
+// Returns the version of Kismet that created the database and the version of its layout
+func (client *tableClient) Versions() (string, int) {
+	return client.KismetVersion, client.DBVersion
+}
+
+func (client *tableClient) Finish() error {
+	client.Ready = false
+	if client.query != nil {
+		client.query.close()
+	}
+	return client.db.Close()
+}
@@ -0,0 +1,313 @@
+package kismetClient
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How long to wait for Kismet to finish writing when it has the database locked
+const busyTimeout = 5 * time.Second
+
+// Builds the SQLite URI used to open a kismetdb. Databases are always opened read-only, so that
+// reading a file Kismet is still logging to can't get in the way of Kismet, and queries are kept
+// from changing any database, including ones they attach. Every query is a
+// single statement, so in WAL mode each one reads a consistent snapshot of the database while
+// Kismet keeps writing to it. An immutable database is read without taking any locks or
+// creating the files SQLite keeps next to a WAL database, which is only safe when nothing can
+// be writing to it.
+func kismetDSN(dbFile string, immutable bool) string {
+	dsn := fmt.Sprintf("file:%s?mode=ro&_query_only=1&_busy_timeout=%d", dsnPath(dbFile), busyTimeout.Nanoseconds() / int64(time.Millisecond))
+	if immutable {
+		dsn += "&immutable=1"
+	}
+
+	return dsn
+}
+
+// Escapes the characters that mean something in a SQLite URI
+func dsnPath(file string) string {
+	return strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(filepath.ToSlash(file))
+}
+
+// Returns true if the file could be written to. The file is opened for writing to find out but
+// nothing is written.
+func writable(file string) bool {
+	if handle, err := os.OpenFile(file, os.O_WRONLY, 0) ; err == nil {
+		handle.Close()
+		return true
+	}
+	return false
+}
+
+// Opens a kismetdb and works out which version of the layout it uses. The caller must close the
+// returned database.
+func openKismetDB(dbFile string) (*sql.DB, string, int, *KismetSchema, error) {
+	if info, err := os.Stat(dbFile) ; os.IsNotExist(err) {
+		return nil, "", 0, nil, KismetDBError(fmt.Sprintf("%s does not exist!", dbFile))
+	} else if err != nil {
+		return nil, "", 0, nil, KismetDBError(fmt.Sprintf("Can't read %s: %v", dbFile, err))
+	} else if info.IsDir() {
+		return nil, "", 0, nil, KismetDBError(fmt.Sprintf("%s is a directory", dbFile))
+	}
+
+	db, kismetVersion, dbVersion, err := openVersioned(kismetDSN(dbFile, false))
+	if err != nil && !writable(dbFile) {
+		// Files on read-only media can't be opened normally when SQLite needs to create its
+		// shared memory file next to them. Nothing can be writing to them, so they are safe to
+		// read as immutable.
+		db, kismetVersion, dbVersion, err = openVersioned(kismetDSN(dbFile, true))
+	}
+	if err != nil {
+		return nil, "", 0, nil, KismetDBError(fmt.Sprintf("%s does not look like a kismetdb: %v", dbFile, err))
+	}
+
+	schema, err := SchemaForVersion(dbVersion)
+	if err != nil {
+		db.Close()
+		return nil, "", 0, nil, err
+	}
+
+	return db, kismetVersion, dbVersion, schema, nil
+}
+
+// Opens a database and reads its versions, which is the first point where SQLite has to be able
+// to read the file
+func openVersioned(dsn string) (*sql.DB, string, int, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	// The version decides how the rest of the database is read
+	kismetVersion, dbVersion, err := readKismetVersion(db)
+	if err != nil {
+		db.Close()
+		return nil, "", 0, err
+	}
+
+	return db, kismetVersion, dbVersion, nil
+}
+
+// Returns the names of the columns a table actually has. Columns have been added to the kismetdb
+// tables over time, so older databases don't have all of them.
+func tableColumns(db *sql.DB, table string) ([]string, error) {
+	reports, err := tableColumnReports(db, table)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(reports) == 0 {
+		return nil, KismetDBError(fmt.Sprintf("The database has no %s table", table))
+	}
+
+	columns := make([]string, len(reports))
+	for i, v := range reports {
+		columns[i] = v.Name
+	}
+	return columns, nil
+}
+
+// Returns the columns of a table with the types SQLite declares for them. A table that doesn't
+// exist has no columns.
+func tableColumnReports(db *sql.DB, table string) ([]ColumnReport, error) {
+	quoted, err := quoteIdentifier(table)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("pragma table_info(" + quoted + ");")
+	if err != nil {
+		return nil, KismetDBError(fmt.Sprint("Failed to read the columns of ", table, ": ", err))
+	}
+	defer rows.Close()
+
+	var columns []ColumnReport
+	for rows.Next() {
+		var (
+			cid, notNull, primaryKey int
+			column ColumnReport
+			defaultValue interface{}
+		)
+		if err := rows.Scan(&cid, &column.Name, &column.Type, &notNull, &defaultValue, &primaryKey) ; err != nil {
+			return nil, KismetDBError(fmt.Sprint("Failed to read the columns of ", table, ": ", err))
+		}
+		columns = append(columns, column)
+	}
+
+	if err := rows.Err() ; err != nil {
+		return nil, KismetDBError(fmt.Sprint("Failed to read the columns of ", table, ": ", err))
+	}
+	return columns, nil
+}
+
+// Returns the order by clause that reads the rows of a table in the order they were seen
+func timeOrder(table TableSchema) string {
+	timeColumn, _ := quoteIdentifier(table.FirstTime)
+	if table.SubTime == "" {
+		return " order by " + timeColumn
+	}
+	subTimeColumn, _ := quoteIdentifier(table.SubTime)
+	return " order by " + timeColumn + ", " + subTimeColumn
+}
+
+// A tableQuery reads rows from one table of a kismetdb. It is what the clients for the specific
+// tables (packets, alerts and so on) are built on. It takes care of leaving out columns the
+// database is too old to have, applying the QueryFilter and scanning rows into plain Go values.
+type tableQuery struct {
+	db *sql.DB
+	schema *KismetSchema
+	table TableSchema
+
+	// The columns to read. Columns that the table doesn't have read as nil
+	columns []string
+	// Restricts the rows that are read
+	filter QueryFilter
+	// Extra conditions that the client needs, combined with the filter using and
+	conditions []string
+	args []interface{}
+	// Appended to the query, such as an order by clause
+	suffix string
+
+	rows *sql.Rows
+	selected []string
+	targets []interface{}
+}
+
+// Builds and runs the query
+func (query *tableQuery) run() error {
+	available, err := tableColumns(query.db, query.table.Name)
+	if err != nil {
+		return err
+	}
+
+	query.selected = make([]string, 0, len(query.columns))
+	quotedColumns := make([]string, 0, len(query.columns))
+	for _, v := range query.columns {
+		for _, have := range available {
+			if v == have {
+				quoted, err := quoteIdentifier(v)
+				if err != nil {
+					return err
+				}
+				query.selected = append(query.selected, v)
+				quotedColumns = append(quotedColumns, quoted)
+				break
+			}
+		}
+	}
+
+	if len(quotedColumns) == 0 {
+		return KismetDBError(fmt.Sprint("None of the needed columns are in the ", query.table.Name, " table"))
+	}
+
+	quotedTable, err := quoteIdentifier(query.table.Name)
+	if err != nil {
+		return err
+	}
+
+	where, args, err := query.filter.where(query.table, query.schema)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range query.conditions {
+		if where == "" {
+			where = " where " + v
+		} else {
+			where += " and " + v
+		}
+	}
+	args = append(args, query.args...)
+
+	statement := "select " + strings.Join(quotedColumns, ", ") + " from " + quotedTable + where + query.suffix + ";"
+	if rows, err := query.db.Query(statement, args...) ; err == nil {
+		query.rows = rows
+	} else {
+		return KismetDBError(fmt.Sprint("DB Query failed: ", err))
+	}
+
+	columns, err := query.rows.Columns()
+	if err != nil {
+		return KismetDBError(fmt.Sprint("Failed to read the columns: ", err))
+	}
+
+	query.targets = make([]interface{}, len(columns))
+	for i := range columns {
+		query.targets[i] = scanTarget()
+	}
+
+	return nil
+}
+
+// Returns the next row, or nil once there are no more rows
+func (query *tableQuery) next() (dbRow, error) {
+	if !query.rows.Next() {
+		// Next() also returns false when iterating failed part way through
+		if err := query.rows.Err() ; err != nil {
+			return nil, KismetDBError(fmt.Sprint("Failed to read from database: ", err))
+		}
+		return nil, nil
+	}
+
+	if err := query.rows.Scan(query.targets...) ; err != nil {
+		return nil, KismetDBError(fmt.Sprint("Failed to parse database: ", err))
+	}
+
+	row := make(dbRow, len(query.selected))
+	for i, v := range query.selected {
+		row[v] = scannedValue(query.targets[i])
+	}
+
+	return row, nil
+}
+
+func (query *tableQuery) close() {
+	if query.rows != nil {
+		query.rows.Close()
+	}
+}
+
+// A single row of a table by column name. Columns that were not read are nil.
+type dbRow map[string]interface{}
+
+func (row dbRow) int(column string) int64 {
+	switch v := row[column].(type) {
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+func (row dbRow) float(column string) float64 {
+	if v, ok := numberValue(row[column]) ; ok {
+		return v
+	}
+	return 0
+}
+
+func (row dbRow) string(column string) string {
+	switch v := row[column].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case Blob:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Returns a coordinate column decoded for the schema
+func (row dbRow) coordinate(schema *KismetSchema, column string) float64 {
+	if v, err := schema.Coordinate(row[column]) ; err == nil {
+		return v
+	}
+	return 0
+}
@@ -1,24 +1,71 @@
 package main
 
 import (
-	"bytes"
+	"encoding/csv"
 	"flag"
 	"fmt"
 	"github.com/AWildBeard/kismetDataTool/kismetClient"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/url"
 	"os"
 	"strings"
+	"time"
 )
 
 var (
 	// Flags
 	kismetUrl string
 	kismetDB string
+	// Every file named by -dbFile, after expanding globs. kismetDB is the first of them
+	kismetDBFiles []string
+	dbFilePatterns fileList
+	// The devices of the -dbFile files are merged, even if a glob matched only one file
+	mergeDBFiles bool
+	mergeLocation string
 	filterSpec string
 	output string
+	exportMode string
+	outputFormat string
+	rotateRows int64
+	rotateSize string
+	rotateNaming string
+
+	writeMeta bool
+
+	filterSince string
+	filterUntil string
+	filterPhy string
+	filterMinSignal string
+	filterMACPrefix string
+	filterType string
+	filterDatasource string
+	filterArea string
+	filterMACs string
+	dbFilter kismetClient.QueryFilter
+	enrichDevices bool
+
+	sanitizeKeyFile string
+	coarsenPrecision int
+
+	followDB bool
+	followInterval time.Duration
+
+	readWorkers int
+	orderedRead bool
+
+	sqlQuery string
+	sqlLat string
+	sqlLon string
+	sqlID string
+	sqlCoordinates string
+
+	sampleEvery int
+	sampleInterval time.Duration
+
+	tableColumns string
+	tableWidth int
+	pageTable bool
 
 	help      bool
 	debug     bool
@@ -31,9 +78,15 @@ var (
 	dbMode bool
 	restMode bool
 
+	// The status the program exits with
+	exitStatus int
+
+	columns []columnSpec
+
 	outputFunc func(reader kismetClient.DataLineReader) error
 
-	outputWriter io.Writer
+	sink *outputSink
+	provenance *exportMetadata
 
 	dlog      *log.Logger
 	ilog      *log.Logger
@@ -42,7 +95,16 @@ var (
 func init() {
 	const (
 		urlUsage   = "Used to identify the URL to access the Kismet REST API ``\n"
-		dbUsage = "Used to identify a local Kismet sqlite3 database file ``\n"
+		dbUsage = "Used to identify a local Kismet sqlite3 database file. May be\n" +
+			"given more than once, or as a glob such as `'logs/*.kismet'`, to\n" +
+			"merge the devices of several files into one export. A glob is\n" +
+			"merged even when it matches a single file. Merged\n" +
+			"devices are matched by MAC address and PHY, and -filter only\n" +
+			"renames and formats the merged columns, like in -mode\n"
+		mergeLocationUsage = "How devices merged from several -dbFile files are located.\n" +
+			"`signal` uses the location from the file where the device was\n" +
+			"heard the loudest. `average` averages the locations from every\n" +
+			"file weighted by the number of packets in each\n"
 		filterUsage = "This flag is used to set a filter for the Kismet REST API if the\n" +
 			"-restURL flag is used, **or** this flag is used to set a filter\n" +
 			"for a kismet sqlite3 database if the -dbFile flag is used. This\n" +
@@ -58,7 +120,27 @@ func init() {
 			"When using the -dbFile flag, filters must be specified by their\n" +
 			"column names in their respective tables. A valid dbFile filter\n" +
 			"might look like the following: `devices/devmac devices/avg_lat`\n" +
-			"etc. All dbFile filters must specify the same table.\n"
+			"etc. All dbFile filters must specify the same table.\n" +
+			"Fields inside the JSON record stored in a column (such as the\n" +
+			"device column of the devices table) are reached by following\n" +
+			"the column with a colon and a REST style field path, such as\n" +
+			"`devices/device:dot11.device/dot11.device.last_beaconed_ssid`\n\n" +
+			"Any filter can be followed by options that rename the column\n" +
+			"or format its values, such as `devices/first_time:as=first_seen:fmt=rfc3339`\n" +
+			"`as=name` replaces the column header. `fmt=a,b` applies the\n" +
+			"formatters in order. The formatters are:\n" +
+			"  rfc3339     unix epoch to an RFC3339 UTC time\n" +
+			"  local       unix epoch to an RFC3339 local time\n" +
+			"  precN       round a coordinate to N decimal places\n" +
+			"  upper       upper case (such as MAC addresses)\n" +
+			"  lower       lower case\n" +
+			"  colon       separate MAC address octets with :\n" +
+			"  dash        separate MAC address octets with -\n" +
+			"  bare        remove MAC address separators\n" +
+			"  bytes       byte count to a human readable size\n" +
+			"  hex         binary data as hex (the default)\n" +
+			"  base64      binary data as base64\n" +
+			"  text        binary data as text, such as JSON in a BLOB\n"
 		outputUsage = "``Used to select the destination output for the data gathered by\n" + // Weirdness here to customize output
 			"this program. To write the data to STDOUT (in a csv-like\n" +
 			"manner) the argument should be `-`. File format specifications\n" +
@@ -66,7 +148,128 @@ func init() {
 			"flag. For example, if you would like to output a csv, you would\n" +
 			"use the flag `-output out.csv`. The default is to output in a\n" +
 			"csv-like manner to stdout. The default is to write to STDOUT.\n" +
-			"The supported file formats are: csv, kml\n"
+			"Files are only replaced once the export has finished, so a\n" +
+			"failed export never leaves a partially written file behind.\n" +
+			"The supported file formats are: csv, kml, txt (table)\n"
+
+		modeUsage = "Export one of the kismet sqlite3 database tables with its own\n" +
+			"fixed set of columns instead of the columns chosen by -filter.\n" +
+			"The alerts mode also works with -restUrl.\n" +
+			"In these modes -filter is optional and only renames and formats\n" +
+			"the columns of the mode, such as `timestamp:fmt=local`.\n" +
+			"The modes are:\n" +
+			"  packets     every packet captured with a GPS fix\n" +
+			"  alerts      every alert Kismet raised, such as deauth floods\n" +
+			"  datasources the radios Kismet captured with, their hardware\n" +
+			"              and channels\n" +
+			"  messages    the messages the Kismet server logged\n" +
+			"  snapshots   the periodic system and GPS snapshots as JSON\n" +
+			"  data        what the SDR datasources heard: rtl_433 sensors\n" +
+			"              with their model, ID and readings, ADS-B aircraft\n" +
+			"              with their ICAO address, callsign, altitude, heading\n" +
+			"              and speed, and AMR meters with their ID and reading\n" +
+			"  inspect     describe the database instead of exporting it: its\n" +
+			"              tables, columns and row counts, the time range,\n" +
+			"              GPS coverage, PHYs and the JSON fields of devices.\n" +
+			"              Use it to find the columns for -filter\n" +
+			"  pcapng      write the logged packets to a pcapng capture for\n" +
+			"              Wireshark. Each packet has a comment with where it\n" +
+			"              was captured and its signal. Use -since, -until,\n" +
+			"              -mac-prefix and -datasource to choose the packets\n" +
+			"  subset      write a new kismetdb that Kismet can load, with only\n" +
+			"              the devices, packets, alerts and data matching\n" +
+			"              -since, -until, -bbox, -macs, -mac-prefix and -phy.\n" +
+			"              Datasources are kept, messages and snapshots are not\n" +
+			"  sanitize    write a copy of the kismetdb that can be shared. MAC\n" +
+			"              addresses and SSIDs are replaced by pseudonyms in\n" +
+			"              every table and JSON record, and packets only keep\n" +
+			"              their 802.11 headers. See -key-file and -coarsen\n" +
+			"  recover     write a copy of a damaged kismetdb, such as one left\n" +
+			"              by a sensor that lost power, with every row that can\n" +
+			"              still be read. What was lost is reported on STDERR.\n" +
+			"              The copy can then be exported like any other\n" +
+			"  tracks      write the flight of each ADS-B aircraft to a KML\n" +
+			"              file as a track with its altitude and times, for\n" +
+			"              Google Earth. Only messages with a position are used\n"
+		sampleEveryUsage = "Only keep every Nth packet (packets mode) ``\n"
+		sampleIntervalUsage = "Only keep the first packet from each device in every interval\n" +
+			"of this length, such as `10s` (packets mode)\n"
+		sinceUsage = "Only export rows seen at or after this time. Accepts RFC3339,\n" +
+			"a local `2006-01-02 15:04` or unix epoch seconds. (dbFile only)\n"
+		untilUsage = "Only export rows seen at or before this time. Accepts the\n" +
+			"same formats as -since. (dbFile only) ``\n"
+		phyUsage = "Only export rows from this PHY, such as `IEEE802.11` (dbFile only)\n"
+		minSignalUsage = "Only export rows with a signal of at least this many dBm, such\n" +
+			"as `-70` (dbFile only)\n"
+		macPrefixUsage = "Only export rows whose MAC address starts with this prefix,\n" +
+			"such as `AA:BB:CC` (dbFile only)\n"
+		datasourceUsage = "Only export rows captured by this datasource, given by its name\n" +
+			"such as `wlan0` or its UUID (dbFile only)\n"
+		areaUsage = "Only export rows located inside this area, given as\n" +
+			"`minLat,minLon,maxLat,maxLon` (dbFile only)\n"
+		macsUsage = "Only export rows involving one of these comma separated MAC\n" +
+			"addresses. Packets match if any of their MAC addresses is in\n" +
+			"the list. `@file` reads the MAC addresses from a file with one\n" +
+			"on each line (dbFile only)\n"
+		followUsage = "Keep running after the export and write the rows Kismet adds to\n" +
+			"the -dbFile database as they come in, like tail -f. Devices are\n" +
+			"written again whenever Kismet updates them. Stops on Ctrl-C.\n" +
+			"Files are written as the rows arrive instead of once the export\n" +
+			"has finished. (csv output with -filter only)\n"
+		followIntervalUsage = "How often -follow looks for new rows\n"
+		workersUsage = "Read the -filter table with this many connections at once,\n" +
+			"each reading and decoding its own range of rows. Speeds up\n" +
+			"exports of very large tables such as packets on machines with\n" +
+			"several cores. Rows come out in no particular order unless\n" +
+			"-ordered is given. Can't be used with -enrich (dbFile only) ``\n"
+		orderedUsage = "Keep the rows read with -workers in the order they are stored\n" +
+			"in the database, like a single connection reads them\n"
+		sqlUsage = "Export the rows of this SQL query on the -dbFile database\n" +
+			"instead of -filter columns, for joins, aggregates and the SQLite\n" +
+			"JSON functions. The database is opened read-only. The columns\n" +
+			"named by -sql-lat, -sql-lon and -sql-id come first and the\n" +
+			"other columns follow in order. -filter renames and formats the\n" +
+			"result columns. `@file` reads the query from a file\n"
+		sqlLatUsage = "The result column of -sql holding the latitude\n"
+		sqlLonUsage = "The result column of -sql holding the longitude\n"
+		sqlIDUsage = "The result column of -sql holding the ID. Defaults to the first\n" +
+			"column that isn't the latitude or longitude\n"
+		sqlCoordinatesUsage = "How the -sql latitude and longitude are stored. `auto` goes by\n" +
+			"the version of the database. `scaled` is integers multiplied\n" +
+			"by 100000, like older databases store them. `real` is degrees\n"
+		keyFileUsage = "A file holding the secret key the sanitize mode makes the\n" +
+			"pseudonyms with. The same key always gives the same pseudonyms,\n" +
+			"so keep it to sanitize later surveys the same way. Without it\n" +
+			"a random key is used\n"
+		coarsenUsage = "Round the coordinates of a sanitized copy to this many decimal\n" +
+			"places. 3 is about 100m (sanitize mode)\n"
+		enrichUsage = "Add what the packets and data tables recorded about each device\n" +
+			"after the -filter columns of a devices export: the number of\n" +
+			"packets, their min, max and average signal, the positions of\n" +
+			"the first and last packets with a GPS fix, the datasources that\n" +
+			"saw the device and the number of data records. (dbFile only)\n"
+		typeUsage = "Only export devices of this type, such as `Wi-Fi AP` (dbFile only)\n"
+		formatUsage = "Choose the output format instead of going by the extension of\n" +
+			"the -output file. One of csv, kml or table. `table` writes an\n" +
+			"aligned table for reading on a terminal. Tables are the default\n" +
+			"when writing to STDOUT and STDOUT is a terminal\n"
+		columnsUsage = "Comma separated list of the columns shown in a table, chosen\n" +
+			"by their header or by their position starting at 1 ``\n"
+		widthUsage = "The width of a table. Defaults to $COLUMNS, or 120 ``\n"
+		pageUsage = "Show tables written to a terminal in $PAGER (or less)\n"
+		rotateRowsUsage = "Start a new part file after this many rows have been written.\n" +
+			"Every part file gets its own header. Requires a file -output ``\n"
+		rotateSizeUsage = "Start a new part file once the current one would grow past\n" +
+			"this size. Sizes may use the K, M and G suffixes, e.g. `100M`\n"
+		rotateNameUsage = "How part files are named when rotating. `number` names them\n" +
+			"out.0001.csv, out.0002.csv and so on. `time` names them after\n" +
+			"the UTC time they were started, e.g. out.20190102T150405Z.csv\n"
+
+		metaUsage = "Write a `<output>.meta.json` file next to the output recording\n" +
+			"the data source and its version, the filters, the column types,\n" +
+			"the number of rows, when the export ran, the version of this\n" +
+			"program and the SHA-256 of every file written. Requires a file\n" +
+			"-output\n"
 
 		appendUsage = "Do not print headers for CSV mode. (append)\n"
 		helpUsage  = "Display this help info and exit\n"
@@ -75,14 +278,47 @@ func init() {
 		debugDefault = false
 	)
 
-	flag.StringVar(&kismetDB, "dbFile", "", dbUsage)
+	flag.Var(&dbFilePatterns, "dbFile", dbUsage)
+	flag.StringVar(&mergeLocation, "merge-location", kismetClient.MergeBestSignal, mergeLocationUsage)
 	flag.StringVar(&kismetUrl, "restUrl", "", urlUsage)
 	flag.StringVar(&filterSpec, "filter", "", filterUsage)
 	flag.StringVar(&output, "output", "", outputUsage)
+	flag.StringVar(&exportMode, "mode", "", modeUsage)
+	flag.IntVar(&sampleEvery, "sample-every", 0, sampleEveryUsage)
+	flag.DurationVar(&sampleInterval, "sample-interval", 0, sampleIntervalUsage)
+	flag.StringVar(&filterSince, "since", "", sinceUsage)
+	flag.StringVar(&filterUntil, "until", "", untilUsage)
+	flag.StringVar(&filterPhy, "phy", "", phyUsage)
+	flag.StringVar(&filterMinSignal, "min-signal", "", minSignalUsage)
+	flag.StringVar(&filterMACPrefix, "mac-prefix", "", macPrefixUsage)
+	flag.StringVar(&filterType, "type", "", typeUsage)
+	flag.StringVar(&filterDatasource, "datasource", "", datasourceUsage)
+	flag.StringVar(&filterArea, "bbox", "", areaUsage)
+	flag.StringVar(&filterMACs, "macs", "", macsUsage)
+	flag.BoolVar(&enrichDevices, "enrich", false, enrichUsage)
+	flag.BoolVar(&followDB, "follow", false, followUsage)
+	flag.DurationVar(&followInterval, "follow-interval", 2 * time.Second, followIntervalUsage)
+	flag.IntVar(&readWorkers, "workers", 0, workersUsage)
+	flag.BoolVar(&orderedRead, "ordered", false, orderedUsage)
+	flag.StringVar(&sqlQuery, "sql", "", sqlUsage)
+	flag.StringVar(&sqlLat, "sql-lat", "lat", sqlLatUsage)
+	flag.StringVar(&sqlLon, "sql-lon", "lon", sqlLonUsage)
+	flag.StringVar(&sqlID, "sql-id", "", sqlIDUsage)
+	flag.StringVar(&sqlCoordinates, "sql-coordinates", kismetClient.CoordinatesAuto, sqlCoordinatesUsage)
+	flag.StringVar(&sanitizeKeyFile, "key-file", "", keyFileUsage)
+	flag.IntVar(&coarsenPrecision, "coarsen", -1, coarsenUsage)
+	flag.StringVar(&outputFormat, "format", "", formatUsage)
+	flag.StringVar(&tableColumns, "columns", "", columnsUsage)
+	flag.IntVar(&tableWidth, "width", 0, widthUsage)
+	flag.BoolVar(&pageTable, "page", false, pageUsage)
+	flag.Int64Var(&rotateRows, "rotate-rows", 0, rotateRowsUsage)
+	flag.StringVar(&rotateSize, "rotate-size", "", rotateSizeUsage)
+	flag.StringVar(&rotateNaming, "rotate-name", rotateNumbered, rotateNameUsage)
 
 	flag.BoolVar(&help, "help", false, helpUsage)
 	flag.BoolVar(&debug, "verbose", debugDefault, debugUsage)
 	flag.BoolVar(&appendMode, "append", false, appendUsage)
+	flag.BoolVar(&writeMeta, "meta", false, metaUsage)
 
 	flag.Usage = usage
 }
@@ -96,6 +332,13 @@ func main() {
 	}
 
 	ilog = log.New(os.Stdout, "", 0)
+	// Deferred first so that it runs last, once the output has been cleaned up. An export that
+	// failed exits with a status that scripts can check.
+	defer func() {
+		if exitStatus != 0 {
+			os.Exit(exitStatus)
+		}
+	}()
 	defer fmt.Fprintln(os.Stderr, "Exiting. Have a good day! (っ◕‿◕)っ")
 
 	if debug {
@@ -107,6 +350,17 @@ func main() {
 	defer dlog.Println("FINISH")
 
 	dlog.Println("Parsing command line options")
+	if files, merge, err := expandDBFiles(dbFilePatterns) ; err == nil {
+		kismetDBFiles = files
+		mergeDBFiles = merge
+		if len(files) > 0 {
+			kismetDB = files[0]
+		}
+	} else {
+		ilog.Println("Bad -dbFile:", err)
+		return
+	}
+
 	if kismetUrl == kismetDB {
 		usage()
 		ilog.Println("Please choose either database or rest mode.")
@@ -117,52 +371,220 @@ func main() {
 		dbMode = true
 	}
 
-	if output == "-" {
-		outputWriter = os.Stdout
-		outputFunc = writeCsv
-	} else if strings.Contains(output, ".csv") {
-		var mode int
-		if appendMode { mode = os.O_APPEND } else { mode = os.O_CREATE }
-		if newFile, err := os.OpenFile(output, mode, 0666) ; err == nil {
-			outputWriter = newFile
-		} else {
-			dlog.Printf("Failed to open file %v: %v", output, err)
-			ilog.Println("Could not open selected file")
+	if (sanitizeKeyFile != "" || coarsenPrecision >= 0) && exportMode != "sanitize" {
+		ilog.Println("-key-file and -coarsen are only used by -mode sanitize")
+		return
+	}
+
+	// Captures, databases and tracks are written in their own formats
+	if format := modeFormat(exportMode) ; format != "" {
+		if outputFormat != "" && outputFormat != format {
+			ilog.Println("The", exportMode, "mode can only write", format)
+			return
+		} else if output == "-" && isTerminal(os.Stdout) {
+			ilog.Println("Please choose a file -output for the", exportMode, "mode")
+			return
+		} else if rotateRows > 0 || rotateSize != "" {
+			ilog.Println("The output of the", exportMode, "mode can't be rotated")
+			return
+		} else if format != "pcapng" && appendMode {
+			ilog.Println("The output of the", exportMode, "mode can't be appended to")
+			return
+		} else if exportMode == "subset" && (filterMinSignal != "" || filterType != "" || filterDatasource != "") {
+			// Not every table that is copied has these columns
+			ilog.Println("Subsets can only be chosen with -since, -until, -bbox, -macs, -mac-prefix and -phy")
+			return
+		} else if (exportMode == "sanitize" || exportMode == "recover") && (filterSince != "" || filterUntil != "" || filterPhy != "" ||
+			filterMinSignal != "" || filterMACPrefix != "" || filterType != "" || filterDatasource != "" ||
+			filterArea != "" || filterMACs != "") {
+			ilog.Println("The", exportMode, "mode copies the whole database. Use -mode subset to narrow it down")
+			return
 		}
-		outputFunc = writeCsv
-	} else if strings.Contains(output, ".kml") {
-		var mode int
-		if appendMode { mode = os.O_APPEND } else { mode = os.O_CREATE }
-		if newFile, err := os.OpenFile(output, mode, 0666) ; err == nil {
-			outputWriter = newFile
-		} else {
-			dlog.Printf("Failed to open file %v: %v", output, err)
-			ilog.Println("Could not open selected file")
+		outputFormat = format
+	}
+
+	if outputFormat == "" {
+		if output == "-" && isTerminal(os.Stdout) {
+			outputFormat = "table"
+		} else if output == "-" || strings.Contains(output, ".csv") {
+			outputFormat = "csv"
+		} else if strings.Contains(output, ".kml") {
+			outputFormat = "kml"
+		} else if strings.Contains(output, ".txt") {
+			outputFormat = "table"
 		}
+	}
+
+	if outputFormat == "csv" {
+		outputFunc = writeCsv
+	} else if outputFormat == "kml" {
 		outputFunc = writeKml
+	} else if outputFormat == "table" {
+		outputFunc = writeTable
+	} else if outputFormat != "" && outputFormat == modeFormat(exportMode) {
+		// Written by the mode itself
 	} else {
 		dlog.Println("Invalid output format specified:", output)
 		ilog.Println("Please choose a supported output format. See the help page for more info.")
 		return
 	}
 
-	if dbMode { // DB mode
+	if sqlQuery != "" {
+		if !dbMode || mergeDBFiles {
+			ilog.Println("-sql queries a single -dbFile")
+			return
+		} else if exportMode != "" || enrichDevices || followDB {
+			ilog.Println("-sql can't be used with -mode, -enrich or -follow")
+			return
+		} else if filterSince != "" || filterUntil != "" || filterPhy != "" || filterMinSignal != "" ||
+			filterMACPrefix != "" || filterType != "" || filterDatasource != "" || filterArea != "" ||
+			filterMACs != "" {
+			ilog.Println("Row filters such as -since can't be used with -sql. Put them in the query instead")
+			return
+		}
+
+		if query, err := readSQLQuery(sqlQuery) ; err == nil && query != "" {
+			sqlQuery = query
+		} else if err == nil {
+			ilog.Println("Bad -sql: the query is empty")
+			return
+		} else {
+			ilog.Println("Bad -sql:", err)
+			return
+		}
+
+		switch sqlCoordinates {
+		case kismetClient.CoordinatesAuto, kismetClient.CoordinatesScaled, kismetClient.CoordinatesReal:
+		default:
+			ilog.Println("Please choose auto, scaled or real for -sql-coordinates")
+			return
+		}
+	} else if sqlID != "" || sqlCoordinates != kismetClient.CoordinatesAuto {
+		ilog.Println("-sql-id and -sql-coordinates are only used with -sql")
+		return
+	}
+
+	if followDB && (!dbMode || exportMode != "" || mergeDBFiles) {
+		ilog.Println("-follow only works for -filter exports of a single -dbFile")
+		return
+	} else if followDB && outputFormat != "csv" {
+		ilog.Println("-follow can only write csv")
+		return
+	} else if followInterval <= 0 {
+		ilog.Println("Please choose a positive -follow-interval")
+		return
+	}
+
+	if readWorkers < 0 {
+		ilog.Println("Please choose a positive number of -workers")
+		return
+	} else if readWorkers > 1 && (!dbMode || exportMode != "" || mergeDBFiles || sqlQuery != "") {
+		ilog.Println("-workers only works for -filter exports of a single -dbFile")
+		return
+	} else if readWorkers > 1 && followDB {
+		ilog.Println("-workers can't be used with -follow")
+		return
+	} else if readWorkers > 1 && enrichDevices {
+		// Every range would aggregate the whole packets and data tables again
+		ilog.Println("-workers can't be used with -enrich")
+		return
+	} else if orderedRead && readWorkers <= 1 {
+		ilog.Println("-ordered is only used with -workers")
+		return
+	}
+
+	// Nothing is written to the destination until the export has finished successfully, unless
+	// the rows are being followed
+	sink = newOutputSink(output, appendMode)
+	if followDB {
+		sink.SetStreaming()
+	}
+	defer sink.Abort()
+
+	if size, err := parseSize(rotateSize) ; err == nil {
+		if err := sink.SetRotation(rotateRows, size, rotateNaming) ; err != nil {
+			dlog.Println("Invalid rotation options:", err)
+			ilog.Println("Please choose valid rotation options. See the help page for more info.")
+			return
+		}
+	} else {
+		dlog.Println("Failed to parse rotation size:", err)
+		ilog.Println("Please choose a valid -rotate-size. See the help page for more info.")
+		return
+	}
+
+	dlog.Println("Parsing column specifications")
+	if newColumns, err := parseColumnSpecs(filterSpec) ; err == nil {
+		columns = newColumns
+	} else {
+		dlog.Println("Failed to parse column specifications:", err)
+		ilog.Println("Bad filter:", err)
+		return
+	}
+
+	if writeMeta {
+		if output == "-" {
+			ilog.Println("Metadata can only be written for a file -output")
+			return
+		}
+		provenance = newExportMetadata(strings.Fields(filterSpec), os.Args)
+	}
+
+	if exportMode != "" && !validMode(exportMode) {
+		ilog.Println("Unknown mode:", exportMode)
+		return
+	} else if exportMode != "" && !dbMode && !validRestMode(exportMode) {
+		ilog.Println("The", exportMode, "mode requires -dbFile")
+		return
+	} else if enrichDevices && (exportMode != "" || !dbMode) {
+		ilog.Println("-enrich only works for devices exports with -dbFile")
+		return
+	} else if mergeDBFiles && (exportMode != "" || enrichDevices) {
+		ilog.Println("Only devices can be merged from a -dbFile glob or several -dbFile files")
+		return
+	}
+
+	var exportErr error
+	if dbMode && mergeDBFiles { // Merging several databases
+		if newFilter, err := buildQueryFilter() ; err == nil {
+			dbFilter = newFilter
+		} else {
+			ilog.Println("Bad row filter:", err)
+			return
+		}
+
+		dlog.Println("Merging", len(kismetDBFiles), "databases")
+		exportErr = doMerge()
+	} else if dbMode && exportMode != "" { // One of the table modes
+		if newFilter, err := buildQueryFilter() ; err == nil {
+			dbFilter = newFilter
+		} else {
+			ilog.Println("Bad row filter:", err)
+			return
+		}
+
+		dlog.Println("Running", exportMode, "export")
+		exportErr = doMode(exportMode)
+	} else if dbMode && sqlQuery != "" { // A query of the user's own
+		dlog.Println("Running SQL query:", sqlQuery)
+		exportErr = doSQL(sqlQuery)
+	} else if dbMode { // DB mode
 		var (
 			table string
-			columns []string
+			dbColumns []string
 		)
 
 		dlog.Println("Parsing db filters")
-		columns = make([]string, 0)
-		for _, v := range strings.Split(filterSpec, " ") {
-			subFilter := strings.Split(v, "/")
+		dbColumns = make([]string, 0)
+		for _, v := range columnFilters(columns) {
+			subFilter := strings.SplitN(v, "/", 2) // JSON fields have slashes of their own
 			if len(subFilter) != 2 {
 				ilog.Println("Bad DB Filter:", v)
 				return
 			}
 
 			newTable := subFilter[0]
-			columns = append(columns, subFilter[1])
+			dbColumns = append(dbColumns, subFilter[1])
 			if table == "" {
 				table = newTable
 			} else if table != newTable {
@@ -170,12 +592,19 @@ func main() {
 				return
 			}
 		}
+		if newFilter, err := buildQueryFilter() ; err == nil {
+			dbFilter = newFilter
+		} else {
+			ilog.Println("Bad row filter:", err)
+			return
+		}
+
 		dlog.Println("Using table:", table)
-		dlog.Println("Using columns:", columns)
+		dlog.Println("Using columns:", dbColumns)
 		dlog.Println("Successfully parsed DB filters")
 
 		dlog.Println("Running database command")
-		doDB(table, columns)
+		exportErr = doDB(table, dbColumns)
 	} else { // REST mode
 		// Test the url and filter flags before prompting for username and password
 		if testUrl, err := url.Parse(kismetUrl) ; err == nil {
@@ -193,13 +622,20 @@ func main() {
 		}
 		dlog.Println("Using Kismet URL:", kismetUrl)
 
+		if filterSince != "" || filterUntil != "" || filterPhy != "" || filterMinSignal != "" ||
+			filterMACPrefix != "" || filterType != "" || filterDatasource != "" || filterArea != "" ||
+			filterMACs != "" {
+			ilog.Println("Row filters such as -since are only supported with -dbFile")
+			return
+		}
+
 		// Basic check. If they are bad filters, let kismet error out instead of us :D
-		if filterSpec == "" {
+		if filterSpec == "" && exportMode == "" {
 			usage()
 			ilog.Println("Please specify filters for rest calls")
 			return
 		}
-		dlog.Println("Using filters:", filterSpec)
+		dlog.Println("Using filters:", columnFilters(columns))
 
 		// Get kismet username and password
 		fmt.Print("Kismet username: ")
@@ -223,35 +659,87 @@ func main() {
 
 		dlog.Println("Successfully parsed required options for kismet REST client")
 
-		dlog.Println("Running REST command")
-		doRest(strings.Split(filterSpec, " "))
+		if exportMode != "" {
+			dlog.Println("Running", exportMode, "export")
+			exportErr = doRestMode(exportMode)
+		} else {
+			dlog.Println("Running REST command")
+			exportErr = doRest(columnFilters(columns))
+		}
+	}
+
+	if exportErr != nil {
+		dlog.Println("Export failed, discarding output:", exportErr)
+		exitStatus = 1
+		return
+	}
+
+	if err := sink.Commit() ; err != nil {
+		dlog.Println("Failed to write output:", err)
+		ilog.Println("Could not write the selected output file")
+		exitStatus = 1
+		return
+	}
+
+	for _, v := range sink.Files() {
+		dlog.Println("Wrote", v.Path)
+	}
+
+	if err := provenance.write(output, sink.Files()) ; err != nil {
+		dlog.Println("Failed to write metadata:", err)
+		ilog.Println("Could not write the metadata file")
+		exitStatus = 1
 	}
 }
 
-func doRest(restFilters []string) {
+func doRest(restFilters []string) error {
 	var (
 		kClient kismetClient.KismetRestClient
 	)
 
-	dlog.Println("Creating Kismet client")
-	// Get a client to the Kismet REST api
-	if newKClient, err := kismetClient.NewRestClient(kismetUrl, kismetUsername, kismetPassword, restFilters) ; err == nil {
-		dlog.Println("Created kismet client")
+	if newKClient, err := connectRest(restFilters) ; err == nil {
 		kClient = newKClient
 		defer kClient.Finish()
 	} else {
-		dlog.Println("Failed to create kismet client: ", err)
-		ilog.Println("Failed to connect to kismet")
-		return
+		return err
 	}
 
 	// Write the elements
 	if err := outputFunc(&kClient) ; err != nil {
 		dlog.Println("Error writing output:", err)
+		ilog.Println("Failed to export data from kismet:", err)
+		return err
 	}
+
+	return nil
 }
 
-func doDB(table string, columns []string) {
+// Logs in to the Kismet REST API and records the server as the source of the export
+func connectRest(restFilters []string) (kismetClient.KismetRestClient, error) {
+	dlog.Println("Creating Kismet client")
+	// Get a client to the Kismet REST api
+	if newKClient, err := kismetClient.NewRestClient(kismetUrl, kismetUsername, kismetPassword, restFilters) ; err == nil {
+		dlog.Println("Created kismet client")
+
+		if provenance != nil {
+			source := sourceInfo{Type: "rest", URL: kismetUrl}
+			if serverVersion, err := newKClient.ServerVersion() ; err == nil {
+				source.KismetVersion = serverVersion
+			} else {
+				dlog.Println("Failed to read the Kismet server version:", err)
+			}
+			provenance.setSource(source)
+		}
+
+		return newKClient, nil
+	} else {
+		dlog.Println("Failed to create kismet client: ", err)
+		ilog.Println("Failed to connect to kismet")
+		return kismetClient.KismetRestClient{}, err
+	}
+}
+
+func doDB(table string, columns []string) error {
 	var (
 		dbClient kismetClient.KismetDBClient
 	)
@@ -261,30 +749,61 @@ func doDB(table string, columns []string) {
 	if newClient, err := kismetClient.NewDBClient(kismetDB, table, columns) ; err == nil {
 		dlog.Println("Created Kismet client")
 		dbClient = newClient
+		dbClient.Filter = dbFilter
+		dbClient.Enrich = enrichDevices
+		dbClient.Follow = followDB
+		dbClient.Workers = readWorkers
+		dbClient.Ordered = orderedRead
 		defer dbClient.Finish() // Cleanup
+
+		// Catch mistakes in -filter before reading anything
+		warnings, err := dbClient.Validate()
+		for _, v := range warnings {
+			fmt.Fprintln(os.Stderr, "Warning:", v)
+		}
+		if err != nil {
+			dlog.Println("Invalid DB filter:", err)
+			ilog.Println("Bad DB Filter:", err)
+			return err
+		}
+
+		provenance.setSource(sourceInfo{
+			Type: "kismetdb",
+			Path: kismetDB,
+			KismetVersion: dbClient.KismetVersion,
+			DBVersion: dbClient.DBVersion,
+		})
 	} else {
 		dlog.Println("Failed to create a DB Connection:", err)
-		ilog.Println("Failed to read database")
-		return
+		ilog.Println("Failed to read database:", err)
+		return err
 	}
 
 	// Write the elements
 	// So apparently referencing a type that implements a supertype makes it compatible with that supertype
 	if err := outputFunc(&dbClient) ; err != nil {
 		dlog.Println("Error writing output:", err)
+		ilog.Println("Failed to export data from the database:", err)
+		return err
 	}
+
+	if followDB {
+		return follow(&dbClient)
+	}
+
+	return nil
 }
 
 func writeCsv(client kismetClient.DataLineReader) error {
 	var (
 		clientGenerator func () (kismetClient.DataElement, error)
-		byteBuffer *bytes.Buffer
+		stringBuilder strings.Builder
+		csvWriter *csv.Writer
 	)
 
-	{
-		templateBuffer := make([]byte, 0, 4096)
-		byteBuffer = bytes.NewBuffer(templateBuffer)
-	}
+	// Values such as SSIDs and JSON records can contain commas and quotes, so let encoding/csv
+	// quote them
+	csvWriter = csv.NewWriter(&stringBuilder)
 
 	dlog.Println("Creating element generator")
 	if newGenerator, err := client.Elements() ; err == nil {
@@ -293,76 +812,61 @@ func writeCsv(client kismetClient.DataLineReader) error {
 		dlog.Println("Failed to create element generator")
 		return err
 	}
+	provenance.describeColumns(client)
 
-	// Print header
-	if !appendMode { // Open a new scope
+	// The sink decides where the header goes. Every new part gets one, while a file that is
+	// being appended to already has one.
+	{ // Open a new scope
 		dlog.Println("Writing csv header")
-		headers := client.ElementHeaders()
-		headerLen := len(headers)
-		for n, v := range headers {
-			if byteBuffer.Len() >= byteBuffer.Cap() {
-				if _, err := outputWriter.Write(byteBuffer.Bytes()); err != nil {
-					return err
-				}
-			}
-
-			if n == headerLen-1 {
-				byteBuffer.WriteString(fmt.Sprintf("%v", v))
-			} else {
-				byteBuffer.WriteString(fmt.Sprintf("%v,", v))
-			}
-
+		if err := csvWriter.Write(columnHeaders(client)) ; err != nil {
+			return err
 		}
-		byteBuffer.WriteByte('\n') // Newline
+		csvWriter.Flush()
+		sink.SetHeader([]byte(stringBuilder.String()))
+		stringBuilder.Reset()
 	}
 
+	return writeCsvElements(clientGenerator)
+}
+
+// Writes the elements from the generator as csv records, without a header
+func writeCsvElements(clientGenerator func () (kismetClient.DataElement, error)) error {
+	var (
+		stringBuilder strings.Builder
+		csvWriter = csv.NewWriter(&stringBuilder)
+	)
+
 	// Print elements
 	dlog.Println("Writing elements")
-	for elem, err := clientGenerator() ; err == nil && elem.HasData ; elem, err = clientGenerator() {
-		var (
-			stringBuilder strings.Builder
-			outputString string
-		)
-		if _, err := fmt.Fprintf(&stringBuilder, "%v,%v,%v", elem.Lat, elem.Lon, elem.ID) ; err != nil {
+	for {
+		elem, err := clientGenerator()
+		if err != nil {
 			return err
+		} else if !elem.HasData { // No more elements
+			break
 		}
 
-		if elem.HasExtraData() {
-			if _, err := fmt.Fprint(&stringBuilder, ",") ; err != nil {
-				return err
-			}
+		provenance.observe(elementValues(elem))
+		values, err := formatElement(elem)
+		if err != nil {
+			return err
+		}
 
-			extraData := elem.GetExtraData()
-			extraDataLen := len(*extraData)
-			for n, v := range *extraData {
-				if n == extraDataLen - 1 {
-					if _, err := fmt.Fprintf(&stringBuilder, "%v", v) ; err != nil {
-						return err
-					}
-				} else {
-					if _, err := fmt.Fprintf(&stringBuilder, "%v,", v) ; err != nil {
-						return err
-					}
-				}
-			}
+		fields := make([]string, len(values))
+		for n, v := range values {
+			fields[n] = valueString(v)
 		}
 
-		if _, err := fmt.Fprintln(&stringBuilder); err != nil {
+		if err := csvWriter.Write(fields) ; err != nil {
 			return err
 		}
+		csvWriter.Flush()
 
 		// We've built the string now
-		outputString = stringBuilder.String()
-		stringBuilder.Reset()
-
-		if byteBuffer.Len() + len(outputString) >= byteBuffer.Cap() {
-			if _, err := outputWriter.Write(byteBuffer.Bytes()) ; err != nil {
-				return err
-			}
-			byteBuffer.Reset()
+		if err := sink.WriteRecord([]byte(stringBuilder.String())) ; err != nil {
+			return err
 		}
-
-		byteBuffer.WriteString(outputString)
+		stringBuilder.Reset()
 	}
 
 	return nil
@@ -379,7 +883,10 @@ func usage() {
 DESCRIPTION
   This program allows for a limited extraction of device-related
   data from different kismet sources such as a kismet sqlite3 
-  database, or kismet's REST API endpoint. By program paradigm,
+  database, or kismet's REST API endpoint. The -mode flag exports
+  other kinds of data, such as packets, alerts and the radios that
+  were capturing, with their own fixed columns. Outside of the
+  modes, by program paradigm,
   any query to a kismet source must include a method to retrieve
   the latitude of the device in the first filter position,
   a method to retrieve the longitude of the device in the second
@@ -408,6 +915,122 @@ DESCRIPTION
 	kismetDataTool -dbFile kismet-x.kismet \
 	-filter 'devices/avg_lat devices/avg_lon devices/devmac'
 
+  Same as above but only for the access points seen during
+  one afternoon with a signal of at least -70 dBm
+
+	kismetDataTool -dbFile kismet-x.kismet \
+	-filter 'devices/avg_lat devices/avg_lon devices/devmac' \
+	-since '2019-05-04 12:00' -until '2019-05-04 18:00' \
+	-type 'Wi-Fi AP' -min-signal -70
+
+  Export one geotagged packet every 10 seconds for each device
+  as a csv with local timestamps
+
+	kismetDataTool -dbFile kismet-x.kismet -mode packets \
+	-sample-interval 10s -filter 'timestamp:fmt=local' \
+	-output packets.csv
+
+  Find the tables, columns and JSON fields that can be used with
+  -filter
+
+	kismetDataTool -dbFile kismet-x.kismet -mode inspect
+
+  Recover the packets one device sent from a datasource during an
+  afternoon as a capture for Wireshark
+
+	kismetDataTool -dbFile kismet-x.kismet -mode pcapng \
+	-mac-prefix AA:BB:CC:DD:EE:FF -datasource wlan0 \
+	-since '2019-05-04 12:00' -until '2019-05-04 18:00' \
+	-output device.pcapng
+
+  Share the part of a survey inside an area with a partner as a
+  kismetdb they can open in Kismet
+
+	kismetDataTool -dbFile kismet-x.kismet -mode subset \
+	-bbox 38.8,-77.1,38.9,-77.0 -since '2019-05-04' \
+	-output partner.kismet
+
+  Sanitize a survey for publishing, with the key kept from the
+  earlier surveys and coordinates rounded to about 100m
+
+	kismetDataTool -dbFile kismet-x.kismet -mode sanitize \
+	-key-file survey.key -coarsen 3 -output published.kismet
+
+  Save what can be saved from the log of a sensor whose battery
+  died, then export its devices
+
+	kismetDataTool -dbFile kismet-x.kismet -mode recover \
+	-output recovered.kismet
+	kismetDataTool -dbFile recovered.kismet \
+	-filter 'devices/avg_lat devices/avg_lon devices/devmac'
+
+  Map the aircraft a sensor heard during an afternoon in Google
+  Earth, with their altitude
+
+	kismetDataTool -dbFile kismet-x.kismet -mode tracks \
+	-since '2019-05-04 12:00' -until '2019-05-04 18:00' \
+	-output flights.kml
+
+  List the radios that were capturing and what they were tuned to
+
+	kismetDataTool -dbFile kismet-x.kismet -mode datasources \
+	-columns name,interface,hardware,channels
+
+  Export the alerts a running Kismet server is holding as a csv
+
+	kismetDataTool -restUrl http://localhost:2501 -mode alerts \
+	-output alerts.csv
+
+  Merge the devices seen by every sensor over several days into
+  one inventory, with the files that saw each device
+
+	kismetDataTool -dbFile 'logs/*.kismet' -output inventory.csv \
+	-merge-location average
+
+  Export the devices with how many packets each sent, their signal
+  range and where they were first and last seen
+
+	kismetDataTool -dbFile kismet-x.kismet -enrich \
+	-filter 'devices/avg_lat devices/avg_lon devices/devmac' \
+	-output devices.csv
+
+  Feed the devices a sensor logs into a pipeline as they are seen
+  and updated, polling every 10 seconds
+
+	kismetDataTool -dbFile /var/log/kismet/kismet-x.kismet \
+	-filter 'devices/avg_lat devices/avg_lon devices/devmac \
+	devices/last_time:fmt=rfc3339' -follow -follow-interval 10s
+
+  Export where each device's strongest packet was heard, using
+  a query of your own. Older databases store coordinates as
+  integers, which -sql-coordinates auto takes care of
+
+	kismetDataTool -dbFile kismet-x.kismet -output strongest.csv \
+	-sql-id sourcemac -sql 'select sourcemac, lat, lon,
+	max(signal) as signal from packets where lat != 0
+	group by sourcemac'
+
+  Export the position of every packet from a very large database
+  using 8 cores, in the order the packets were logged
+
+	kismetDataTool -dbFile kismet-x.kismet -workers 8 -ordered \
+	-filter 'packets/lat packets/lon packets/sourcemac \
+	packets/ts_sec packets/signal' -output packets.csv
+
+  Same as the first database example but written to devices.0001.csv, devices.0002.csv
+  and so on, with at most 10000 devices in each file
+
+	kismetDataTool -dbFile kismet-x.kismet \
+	-filter 'devices/avg_lat devices/avg_lon devices/devmac' \
+	-output devices.csv -rotate-rows 10000
+
+  Look up a few columns of the devices in a kismet sqlite3
+  database as a table in a pager
+
+	kismetDataTool -dbFile kismet-x.kismet -format table -page \
+	-filter 'devices/avg_lat devices/avg_lon devices/devmac \
+	devices/type devices/strongest_signal' -columns devmac,type
+
 AUTHOR
   Michael Mitchell
 
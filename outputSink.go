@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	rotateNumbered    = "number"
+	rotateTimestamped = "time"
+)
+
+// The outputSink is where the writers send their formatted output. When the destination is a
+// file, everything is written to a temporary file next to the destination and only renamed over
+// it by Commit(). This way an export that fails half way through (a dropped REST connection,
+// a bad row in the database) never leaves a truncated file behind. The sink can also rotate
+// its output into part files once a row count or size limit is reached. Each part starts with
+// its own copy of the header so that every part can be used on its own. Finished parts are kept
+// as temporary files too until Commit(), so a failed export leaves none of its parts behind.
+type outputSink struct {
+	// The destination path. Empty when writing to STDOUT
+	path string
+	// Append to the destination instead of replacing it
+	appendMode bool
+	// Write straight to the destination instead of a temporary file
+	streaming bool
+
+	// Rotation limits. Zero disables the limit
+	rotateRows int64
+	rotateSize int64
+	// How part files are named. Either rotateNumbered or rotateTimestamped
+	rotateNaming string
+
+	header []byte
+
+	// State for the part currently being written
+	part     int
+	rows     int64
+	size     int64
+	file     *os.File
+	tempPath string
+	partPath string
+	writer   *bufio.Writer
+	hasher   hash.Hash
+
+	// Part files that were completely written but are still waiting for Commit() in their
+	// temporary file
+	finished []finishedPart
+	// Part files that have been renamed into place
+	committed []sinkFile
+}
+
+// A part that is waiting for Commit() to be moved from tempPath to its destination
+type finishedPart struct {
+	sinkFile
+	tempPath string
+}
+
+// A file that was completely written by the sink
+type sinkFile struct {
+	Path   string `json:"path"`
+	Rows   int64  `json:"rows"`
+	Size   int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+// Creates a new output sink for the destination. A destination of `-` writes to STDOUT.
+func newOutputSink(path string, appendMode bool) *outputSink {
+	sink := &outputSink{
+		appendMode:   appendMode,
+		rotateNaming: rotateNumbered,
+	}
+
+	if path != "-" {
+		sink.path = path
+	}
+
+	return sink
+}
+
+// Sets the limits at which the sink starts a new part file. Rotation is not supported when
+// writing to STDOUT.
+func (sink *outputSink) SetRotation(rows, size int64, naming string) error {
+	if rows < 0 || size < 0 {
+		return fmt.Errorf("rotation limits can not be negative")
+	}
+
+	if naming != rotateNumbered && naming != rotateTimestamped {
+		return fmt.Errorf("unknown part file naming %q", naming)
+	}
+
+	if sink.path == "" && (rows > 0 || size > 0) {
+		return fmt.Errorf("can not rotate output written to STDOUT")
+	}
+
+	sink.rotateRows = rows
+	sink.rotateSize = size
+	sink.rotateNaming = naming
+	return nil
+}
+
+// Makes the sink write straight to the destination (or the current part) instead of a
+// temporary file, for output that is read while it is still being written. An export that fails
+// leaves what was written so far.
+func (sink *outputSink) SetStreaming() {
+	sink.streaming = true
+}
+
+func (sink *outputSink) rotating() bool {
+	return sink.rotateRows > 0 || sink.rotateSize > 0
+}
+
+// Sets the header that is written at the top of every part. When appending, the part that is
+// appended to does not get a header as it should already have one.
+func (sink *outputSink) SetHeader(header []byte) {
+	sink.header = header
+}
+
+// Writes a single complete record (such as one csv line) to the output. Records are never
+// split across parts.
+func (sink *outputSink) WriteRecord(record []byte) error {
+	if sink.writer != nil && sink.rows > 0 && sink.limitReached(len(record)) {
+		if err := sink.finishPart(); err != nil {
+			return err
+		}
+	}
+
+	if sink.writer == nil {
+		if err := sink.startPart(); err != nil {
+			return err
+		}
+	}
+
+	n, err := sink.writer.Write(record)
+	sink.size += int64(n)
+	sink.rows++
+	return err
+}
+
+// Writes data that is not part of a record, such as a footer or a complete document that is
+// not row based. It is never the cause of a rotation.
+func (sink *outputSink) Write(data []byte) (int, error) {
+	if sink.writer == nil {
+		if err := sink.startPart(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := sink.writer.Write(data)
+	sink.size += int64(n)
+	return n, err
+}
+
+// Writes out everything buffered so far. The output is started if it hasn't been yet, so that
+// the header is there before any records are.
+func (sink *outputSink) Flush() error {
+	if sink.writer == nil {
+		if err := sink.startPart(); err != nil {
+			return err
+		}
+	}
+
+	return sink.writer.Flush()
+}
+
+func (sink *outputSink) limitReached(nextRecord int) bool {
+	if sink.rotateRows > 0 && sink.rows >= sink.rotateRows {
+		return true
+	}
+
+	return sink.rotateSize > 0 && sink.size+int64(nextRecord) > sink.rotateSize
+}
+
+// Opens the next part. For files this is a temporary file in the same directory as the
+// destination so that the final rename can not cross file systems.
+func (sink *outputSink) startPart() error {
+	sink.part++
+	sink.rows = 0
+	sink.size = 0
+
+	if sink.path == "" {
+		sink.writer = bufio.NewWriter(os.Stdout)
+		if !sink.appendMode {
+			return sink.writeHeader()
+		}
+		return nil
+	}
+
+	if sink.rotating() {
+		sink.partPath = sink.nextPartPath()
+	} else {
+		sink.partPath = sink.path
+	}
+
+	if sink.streaming {
+		return sink.startStreamingPart()
+	}
+
+	dir, base := filepath.Split(sink.partPath)
+	if dir == "" {
+		dir = "."
+	}
+
+	newFile, err := ioutil.TempFile(dir, "."+base+".tmp-")
+	if err != nil {
+		return err
+	}
+	sink.file = newFile
+	sink.tempPath = newFile.Name()
+	sink.hasher = sha256.New()
+	sink.writer = bufio.NewWriter(io.MultiWriter(newFile, sink.hasher))
+
+	// Keep the permissions of the file we are replacing
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(sink.partPath); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := newFile.Chmod(mode); err != nil {
+		return err
+	}
+
+	// Only the first part is ever appended to. All the others are new files.
+	if sink.appendMode && sink.part == 1 {
+		if appended, err := sink.copyExisting(); err != nil || appended {
+			return err
+		}
+	}
+
+	return sink.writeHeader()
+}
+
+// Opens the destination of the part itself. When appending to it, what it already holds goes
+// into the hash so that the hash is of the whole file.
+func (sink *outputSink) startStreamingPart() error {
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	appending := sink.appendMode && sink.part == 1
+	if appending {
+		flags = os.O_RDWR | os.O_CREATE | os.O_APPEND
+	}
+
+	newFile, err := os.OpenFile(sink.partPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+	sink.file = newFile
+	sink.tempPath = sink.partPath
+	sink.hasher = sha256.New()
+	sink.writer = bufio.NewWriter(io.MultiWriter(newFile, sink.hasher))
+
+	if appending {
+		n, err := io.Copy(sink.hasher, newFile)
+		sink.size += n
+		if err != nil || n > 0 {
+			return err
+		}
+	}
+
+	return sink.writeHeader()
+}
+
+// Copies the current content of the destination into the temporary file so that appending
+// keeps the same all or nothing behavior as replacing. Reports whether there was anything to
+// append to.
+func (sink *outputSink) copyExisting() (bool, error) {
+	existing, err := os.Open(sink.partPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer existing.Close()
+
+	n, err := io.Copy(sink.writer, existing)
+	sink.size += n
+	return n > 0, err
+}
+
+func (sink *outputSink) writeHeader() error {
+	if len(sink.header) == 0 {
+		return nil
+	}
+
+	n, err := sink.writer.Write(sink.header)
+	sink.size += int64(n)
+	return err
+}
+
+// Returns the path of the next part file. A destination of out.csv becomes out.0001.csv or
+// out.20060102T150405Z.csv depending on the naming.
+func (sink *outputSink) nextPartPath() string {
+	ext := filepath.Ext(sink.path)
+	stem := strings.TrimSuffix(sink.path, ext)
+
+	if sink.rotateNaming == rotateTimestamped {
+		stamp := time.Now().UTC().Format("20060102T150405Z")
+		partPath := stem + "." + stamp + ext
+		// Parts can rotate faster than once a second
+		for n := 1; sink.isUsed(partPath); n++ {
+			partPath = fmt.Sprintf("%s.%s-%d%s", stem, stamp, n, ext)
+		}
+		return partPath
+	}
+
+	return fmt.Sprintf("%s.%04d%s", stem, sink.part, ext)
+}
+
+func (sink *outputSink) isUsed(partPath string) bool {
+	for _, v := range sink.committed {
+		if v.Path == partPath {
+			return true
+		}
+	}
+	for _, v := range sink.finished {
+		if v.Path == partPath {
+			return true
+		}
+	}
+	return false
+}
+
+// Flushes the current part and closes it. A part written to a temporary file is moved into place
+// by Commit().
+func (sink *outputSink) finishPart() error {
+	if sink.writer == nil {
+		return nil
+	}
+
+	err := sink.writer.Flush()
+	sink.writer = nil
+
+	if sink.file == nil { // STDOUT
+		return err
+	}
+
+	if closeErr := sink.file.Close(); err == nil {
+		err = closeErr
+	}
+	sink.file = nil
+
+	if err != nil {
+		if !sink.streaming {
+			os.Remove(sink.tempPath)
+		}
+		return err
+	}
+
+	part := sinkFile{
+		sink.partPath,
+		sink.rows,
+		sink.size,
+		hex.EncodeToString(sink.hasher.Sum(nil)),
+	}
+	if sink.tempPath != sink.partPath {
+		sink.finished = append(sink.finished, finishedPart{part, sink.tempPath})
+	} else {
+		sink.committed = append(sink.committed, part)
+	}
+	sink.tempPath = ""
+	return nil
+}
+
+// Finishes the output. The destination (or the parts) only appear once this returns without
+// error. An empty export still produces a file containing the header.
+func (sink *outputSink) Commit() error {
+	if sink.writer == nil && len(sink.finished) == 0 && len(sink.committed) == 0 {
+		if err := sink.startPart(); err != nil {
+			return err
+		}
+	}
+
+	if err := sink.finishPart(); err != nil {
+		return err
+	}
+
+	for i, part := range sink.finished {
+		if err := os.Rename(part.tempPath, part.Path); err != nil {
+			// Move the parts that were already renamed back, so that Abort() removes them with
+			// the rest and none of the parts are left in place
+			for _, moved := range sink.finished[:i] {
+				os.Rename(moved.Path, moved.tempPath)
+			}
+			return err
+		}
+	}
+
+	for _, part := range sink.finished {
+		sink.committed = append(sink.committed, part.sinkFile)
+	}
+	sink.finished = nil
+	return nil
+}
+
+// Throws away the output. The destination is left untouched, and so are the parts as none of
+// them were moved into place. When streaming, what was written so far is kept instead. Calling
+// Abort() after Commit() does nothing.
+func (sink *outputSink) Abort() {
+	if sink.streaming && sink.writer != nil {
+		sink.writer.Flush()
+	}
+
+	if sink.file != nil {
+		sink.file.Close()
+		if !sink.streaming {
+			os.Remove(sink.tempPath)
+		}
+		sink.file = nil
+	}
+	sink.writer = nil
+
+	for _, v := range sink.finished {
+		os.Remove(v.tempPath)
+	}
+	sink.finished = nil
+}
+
+// Returns the files that were written by this sink.
+func (sink *outputSink) Files() []sinkFile {
+	return sink.committed
+}
+
+// Parses a size such as 100M, 2G, 512K or 1048576 into a number of bytes.
+func parseSize(size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	number := strings.TrimSuffix(strings.ToUpper(size), "B")
+	if number != "" {
+		switch number[len(number)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier != 1 {
+			number = number[:len(number)-1]
+		}
+	}
+
+	value, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+
+	return value * multiplier, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/AWildBeard/kismetDataTool/kismetClient"
+	"os"
+)
+
+// pcapng block types and options. See https://www.ietf.org/id/draft-ietf-opsawg-pcapng
+const (
+	pcapngSectionHeader  = 0x0A0D0D0A
+	pcapngInterface      = 0x00000001
+	pcapngEnhancedPacket = 0x00000006
+	pcapngByteOrderMagic = 0x1A2B3C4D
+
+	// Options of every block
+	pcapngOptEnd     = 0
+	pcapngOptComment = 1
+	// Options of the section header
+	pcapngOptUserAppl = 4
+	// Options of the interface description
+	pcapngOptIfName        = 2
+	pcapngOptIfDescription = 3
+	pcapngOptIfTsresol     = 9
+)
+
+// Writes the blocks of a pcapng file. A single section is written, with an interface for every
+// datasource and link type pair that captured a packet. Interfaces are described the first time
+// they are used, which pcapng allows anywhere in a section before their first packet.
+type pcapngWriter struct {
+	// Packet blocks are written as records so that they are counted like rows. The other blocks
+	// are not records.
+	destination *outputSink
+	// The interface ID of each datasource and link type pair
+	interfaces map[string]uint32
+	// The names of the datasources by UUID, for naming the interfaces
+	datasourceNames map[string]string
+}
+
+func newPcapngWriter(destination *outputSink, datasourceNames map[string]string) *pcapngWriter {
+	return &pcapngWriter{destination, make(map[string]uint32), datasourceNames}
+}
+
+// Appends an option to a block body. Option values are padded to 32 bits.
+func pcapngOption(body *bytes.Buffer, code uint16, value []byte) {
+	binary.Write(body, binary.LittleEndian, code)
+	binary.Write(body, binary.LittleEndian, uint16(len(value)))
+	body.Write(value)
+	body.Write(make([]byte, (4 - len(value) % 4) % 4))
+}
+
+// Wraps a block body in the block type and length. The body must already be padded to 32 bits.
+func pcapngBlock(blockType uint32, body []byte) []byte {
+	var block bytes.Buffer
+	length := uint32(12 + len(body))
+
+	binary.Write(&block, binary.LittleEndian, blockType)
+	binary.Write(&block, binary.LittleEndian, length)
+	block.Write(body)
+	binary.Write(&block, binary.LittleEndian, length)
+
+	return block.Bytes()
+}
+
+func (writer *pcapngWriter) writeSectionHeader() error {
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, uint32(pcapngByteOrderMagic))
+	binary.Write(&body, binary.LittleEndian, uint16(1)) // Major version
+	binary.Write(&body, binary.LittleEndian, uint16(0)) // Minor version
+	binary.Write(&body, binary.LittleEndian, int64(-1)) // Section length is not known up front
+	pcapngOption(&body, pcapngOptUserAppl, []byte("kismetDataTool " + version))
+	pcapngOption(&body, pcapngOptEnd, nil)
+
+	_, err := writer.destination.Write(pcapngBlock(pcapngSectionHeader, body.Bytes()))
+	return err
+}
+
+// Returns the interface ID for the packet, describing a new interface if needed
+func (writer *pcapngWriter) interfaceFor(packet *kismetClient.RawPacket) (uint32, error) {
+	key := fmt.Sprint(packet.Datasource, "/", packet.DLT)
+	if id, ok := writer.interfaces[key]; ok {
+		return id, nil
+	}
+
+	name := writer.datasourceNames[packet.Datasource]
+	if name == "" {
+		name = packet.Datasource
+	}
+
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, uint16(packet.DLT))
+	binary.Write(&body, binary.LittleEndian, uint16(0)) // Reserved
+	binary.Write(&body, binary.LittleEndian, uint32(0)) // No snap length
+	pcapngOption(&body, pcapngOptIfName, []byte(name))
+	pcapngOption(&body, pcapngOptIfDescription, []byte("Kismet datasource " + packet.Datasource))
+	pcapngOption(&body, pcapngOptIfTsresol, []byte{6}) // Microseconds, like Kismet
+	pcapngOption(&body, pcapngOptEnd, nil)
+
+	if _, err := writer.destination.Write(pcapngBlock(pcapngInterface, body.Bytes())); err != nil {
+		return 0, err
+	}
+
+	id := uint32(len(writer.interfaces))
+	writer.interfaces[key] = id
+	return id, nil
+}
+
+// Writes a packet with a comment giving where it was captured and its signal, which Wireshark
+// shows with the packet and can filter on with frame.comment
+func (writer *pcapngWriter) writePacket(packet *kismetClient.RawPacket) error {
+	id, err := writer.interfaceFor(packet)
+	if err != nil {
+		return err
+	}
+
+	timestamp := uint64(packet.Timestamp.UnixNano() / 1000)
+
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, id)
+	binary.Write(&body, binary.LittleEndian, uint32(timestamp >> 32))
+	binary.Write(&body, binary.LittleEndian, uint32(timestamp))
+	binary.Write(&body, binary.LittleEndian, uint32(len(packet.Data)))
+	binary.Write(&body, binary.LittleEndian, uint32(packet.OriginalLength))
+	body.Write(packet.Data)
+	body.Write(make([]byte, (4 - len(packet.Data) % 4) % 4))
+
+	comment := fmt.Sprintf("signal=%d", packet.Signal)
+	if packet.HasFix {
+		comment = fmt.Sprintf("lat=%s lon=%s alt=%s %s", valueString(packet.Lat), valueString(packet.Lon),
+			valueString(packet.Alt), comment)
+	}
+	pcapngOption(&body, pcapngOptComment, []byte(comment))
+	pcapngOption(&body, pcapngOptEnd, nil)
+
+	return writer.destination.WriteRecord(pcapngBlock(pcapngEnhancedPacket, body.Bytes()))
+}
+
+// Writes the packets of the -dbFile database that match the row filters to a pcapng file
+func doPcapng() error {
+	dlog.Println("Creating Kismet client")
+
+	packetClient, err := kismetClient.NewPacketClient(kismetDB)
+	if err != nil {
+		dlog.Println("Failed to create a DB Connection:", err)
+		ilog.Println("Failed to read database:", err)
+		return err
+	}
+	defer packetClient.Finish()
+	packetClient.Filter = dbFilter
+
+	provenance.setSource(sourceInfo{
+		Type:          "kismetdb",
+		Path:          kismetDB,
+		KismetVersion: packetClient.KismetVersion,
+		DBVersion:     packetClient.DBVersion,
+	})
+
+	names, err := packetClient.DatasourceNames()
+	if err != nil {
+		dlog.Println("Failed to read the datasources, naming interfaces by UUID:", err)
+	}
+
+	packets, err := packetClient.RawPackets()
+	if err != nil {
+		ilog.Println("Failed to export data:", err)
+		return err
+	}
+
+	writer := newPcapngWriter(sink, names)
+	if err := writer.writeSectionHeader(); err != nil {
+		return err
+	}
+
+	skipped := 0
+	for {
+		packet, err := packets()
+		if err != nil {
+			ilog.Println("Failed to export data:", err)
+			return err
+		} else if packet == nil { // No more packets
+			break
+		}
+
+		// Kismet logs packets without their contents when packet logging is turned off
+		if len(packet.Data) == 0 {
+			skipped++
+			continue
+		}
+
+		if err := writer.writePacket(packet); err != nil {
+			return err
+		}
+	}
+
+	if skipped > 0 {
+		// The capture itself may be going to STDOUT
+		fmt.Fprintln(os.Stderr, "Skipped", skipped, "packets that were logged without their contents")
+	}
+
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/AWildBeard/kismetDataTool/kismetClient"
+	"time"
+)
+
+// The version of this program. Release builds set this with
+// -ldflags "-X main.version=<tag>"
+var version = "dev"
+
+const metaSuffix = ".meta.json"
+
+// The exportMetadata records how an export was produced. It is written as a sidecar next to the
+// output so that anyone holding the output can see exactly where the data came from and check
+// that the output has not been changed since. All methods are safe to call on a nil
+// *exportMetadata so that callers don't have to care if the sidecar was requested.
+type exportMetadata struct {
+	Tool    toolInfo     `json:"tool"`
+	Source  sourceInfo   `json:"source"`
+	Filters []string     `json:"filters"`
+	Columns []columnInfo `json:"columns"`
+	Rows    int64        `json:"rows"`
+	// The rows written to each table, for the modes that write a kismetdb. Rows is their total
+	Tables   map[string]int64 `json:"tables,omitempty"`
+	Started  time.Time        `json:"started"`
+	Finished time.Time        `json:"finished"`
+	Files    []sinkFile       `json:"files"`
+}
+
+type toolInfo struct {
+	Name    string   `json:"name"`
+	Version string   `json:"version"`
+	Args    []string `json:"args"`
+}
+
+// Where the data came from. Either a kismetdb file, several merged kismetdb files or a Kismet
+// REST endpoint. Query is the -sql query the rows of a kismetdb were read with. Merged files
+// each have their own versions, so they are listed in Files instead of Path.
+type sourceInfo struct {
+	Type          string       `json:"type"`
+	Path          string       `json:"path,omitempty"`
+	Files         []sourceFile `json:"files,omitempty"`
+	Query         string       `json:"query,omitempty"`
+	URL           string       `json:"url,omitempty"`
+	KismetVersion string       `json:"kismet_version,omitempty"`
+	DBVersion     int          `json:"db_version,omitempty"`
+}
+
+// One of the kismetdb files that were merged
+type sourceFile struct {
+	Path          string `json:"path"`
+	KismetVersion string `json:"kismet_version"`
+	DBVersion     int    `json:"db_version"`
+}
+
+type columnInfo struct {
+	Header  string   `json:"header"`
+	Filter  string   `json:"filter,omitempty"`
+	Formats []string `json:"formats,omitempty"`
+	// The type the source declares for the column, such as the SQLite column type
+	SourceType string `json:"source_type,omitempty"`
+	// The Go type of the values that were read from the source
+	ValueType string `json:"value_type,omitempty"`
+}
+
+// Clients that know the types of their columns ahead of time
+type columnTyper interface {
+	ColumnTypes() []string
+}
+
+func newExportMetadata(filters []string, args []string) *exportMetadata {
+	return &exportMetadata{
+		Tool:    toolInfo{"kismetDataTool", version, args[1:]},
+		Filters: filters,
+		Started: time.Now().UTC(),
+	}
+}
+
+func (meta *exportMetadata) setSource(source sourceInfo) {
+	if meta == nil {
+		return
+	}
+	meta.Source = source
+}
+
+// Records the rows written to each table of a kismetdb output. The output is written as one
+// block of bytes, so the sink can't count its rows.
+func (meta *exportMetadata) setTableRows(rows map[string]int64) {
+	if meta == nil {
+		return
+	}
+	meta.Tables = rows
+}
+
+// Records the columns of the client. Must be called after the client's Elements() so that
+// clients that only learn their column types from running their query can report them.
+func (meta *exportMetadata) describeColumns(client kismetClient.DataLineReader) {
+	if meta == nil {
+		return
+	}
+
+	var sourceTypes []string
+	if typer, ok := client.(columnTyper); ok {
+		sourceTypes = typer.ColumnTypes()
+	}
+
+	headers := columnHeaders(client)
+	meta.Columns = make([]columnInfo, len(headers))
+	for n, v := range headers {
+		meta.Columns[n].Header = v
+		meta.Columns[n].Filter = columnAt(n).Filter
+		meta.Columns[n].Formats = columnAt(n).FormatNames
+		if n < len(sourceTypes) {
+			meta.Columns[n].SourceType = sourceTypes[n]
+		}
+	}
+}
+
+// Records the types of the values in a row before they are formatted. The first value that is
+// present in a column decides its type.
+func (meta *exportMetadata) observe(values []interface{}) {
+	if meta == nil {
+		return
+	}
+
+	for n, v := range values {
+		if n >= len(meta.Columns) {
+			meta.Columns = append(meta.Columns, columnInfo{})
+		}
+		if meta.Columns[n].ValueType == "" && v != nil {
+			meta.Columns[n].ValueType = goTypeName(v)
+		}
+	}
+}
+
+func goTypeName(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case float64, float32:
+		return "float"
+	case int, int64, int32, uint64:
+		return "integer"
+	case bool:
+		return "bool"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case kismetClient.Blob:
+		return "blob"
+	case time.Time:
+		return "time"
+	default:
+		return "unknown"
+	}
+}
+
+// Writes the sidecar for the files of a finished export. The sidecar is written atomically,
+// just like the output itself.
+func (meta *exportMetadata) write(outputPath string, files []sinkFile) error {
+	if meta == nil {
+		return nil
+	}
+
+	meta.Finished = time.Now().UTC()
+	meta.Files = files
+	meta.Rows = 0
+	if meta.Tables != nil {
+		for _, v := range meta.Tables {
+			meta.Rows += v
+		}
+	} else {
+		for _, v := range files {
+			meta.Rows += v.Rows
+		}
+	}
+
+	metaJson, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	metaSink := newOutputSink(outputPath+metaSuffix, false)
+	defer metaSink.Abort()
+
+	if _, err := metaSink.Write(append(metaJson, '\n')); err != nil {
+		return err
+	}
+
+	return metaSink.Commit()
+}
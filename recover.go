@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"github.com/AWildBeard/kismetDataTool/kismetClient"
+	"os"
+	"text/tabwriter"
+)
+
+// Writes a copy of the -dbFile database with every row that can still be read, and reports what
+// was lost. The report goes to STDERR, as the copy itself may be going to STDOUT.
+func doRecover() error {
+	var recovery kismetClient.RecoveryReport
+
+	err := writeDBCopy("recovered copy", func(path string) (kismetClient.SubsetReport, error) {
+		var err error
+		recovery, err = kismetClient.RecoverDB(kismetDB, path)
+		return recovery.SubsetReport, err
+	})
+
+	if recovery.PageSize > 0 {
+		reportRecovery(recovery)
+	}
+
+	return err
+}
+
+func reportRecovery(recovery kismetClient.RecoveryReport) {
+	writer := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(writer, format + "\n", args...)
+	}
+
+	line("Recovering %s", kismetDB)
+	if recovery.KismetVersion == "" {
+		line("  Kismet version\tunknown, the KISMET table was lost")
+	} else {
+		line("  Kismet version\t%s", recovery.KismetVersion)
+		line("  DB version\t%d", recovery.DBVersion)
+	}
+	line("  Page size\t%d", recovery.PageSize)
+	if recovery.HeaderPages > recovery.FilePages {
+		line("  Pages\t%d of %d, %d lost from the end of the file", recovery.FilePages, recovery.HeaderPages,
+			recovery.HeaderPages - recovery.FilePages)
+	} else {
+		line("  Pages\t%d", recovery.FilePages)
+	}
+	if recovery.JournalDiscarded {
+		line("  Journal\tdamaged, the last write was left out")
+	}
+
+	for _, table := range recovery.Tables {
+		if table.Err != nil {
+			line("  %s\tunreadable: %v", table.Name, table.Err)
+		} else if table.LostEnd {
+			line("  %s\t%d rows recovered, everything from rowid %d on was lost", table.Name,
+				recovery.Rows[table.Name], table.Lost[len(table.Lost) - 1].First)
+		} else if lost := table.LostRows() ; lost > 0 {
+			line("  %s\t%d rows recovered, up to %d lost", table.Name, recovery.Rows[table.Name], lost)
+		} else {
+			line("  %s\t%d rows recovered", table.Name, recovery.Rows[table.Name])
+		}
+	}
+
+	if len(recovery.Problems) > 0 {
+		line("")
+		line("Problems found by the integrity check:")
+		for _, v := range recovery.Problems {
+			line("  %s", v)
+		}
+	}
+
+	writer.Flush()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"github.com/AWildBeard/kismetDataTool/kismetClient"
+	"io/ioutil"
+	"os"
+)
+
+// Writes a copy of the -dbFile database that can be shared, with pseudonyms for the MAC
+// addresses and SSIDs and without the contents of the packets
+func doSanitize() error {
+	sanitizer := kismetClient.Sanitizer{Precision: coarsenPrecision}
+
+	if sanitizeKeyFile != "" {
+		if key, err := ioutil.ReadFile(sanitizeKeyFile) ; err == nil {
+			sanitizer.Key = bytes.TrimRight(key, "\r\n")
+		} else {
+			ilog.Println("Failed to read the -key-file:", err)
+			return err
+		}
+
+		if len(sanitizer.Key) == 0 {
+			ilog.Println("The -key-file is empty")
+			return fmt.Errorf("%s is empty", sanitizeKeyFile)
+		}
+	} else {
+		sanitizer.Key = make([]byte, 32)
+		if _, err := rand.Read(sanitizer.Key) ; err != nil {
+			return err
+		}
+		// The copy itself may be going to STDOUT
+		fmt.Fprintln(os.Stderr, "No -key-file given, so the pseudonyms won't match those of other sanitized copies")
+	}
+
+	return writeDBCopy("sanitized copy", func(path string) (kismetClient.SubsetReport, error) {
+		return kismetClient.WriteSanitized(kismetDB, path, sanitizer)
+	})
+}
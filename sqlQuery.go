@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/AWildBeard/kismetDataTool/kismetClient"
+	"io/ioutil"
+	"strings"
+)
+
+// Returns the query given to -sql. `@file` reads it from a file.
+func readSQLQuery(value string) (string, error) {
+	if strings.HasPrefix(value, "@") {
+		if contents, err := ioutil.ReadFile(value[1:]); err == nil {
+			value = string(contents)
+		} else {
+			return "", err
+		}
+	}
+
+	return strings.TrimSpace(value), nil
+}
+
+// Exports the rows of the -sql query. -filter only renames and formats the result columns, like
+// in the table modes.
+func doSQL(query string) error {
+	dlog.Println("Creating Kismet client")
+
+	if newClient, err := kismetClient.NewSQLClient(kismetDB, query); err == nil {
+		newClient.LatColumn = sqlLat
+		newClient.LonColumn = sqlLon
+		newClient.IDColumn = sqlID
+		newClient.Coordinates = sqlCoordinates
+		defer newClient.Finish()
+
+		provenance.setSource(sourceInfo{
+			Type:          "kismetdb",
+			Path:          kismetDB,
+			Query:         query,
+			KismetVersion: newClient.KismetVersion,
+			DBVersion:     newClient.DBVersion,
+		})
+
+		return exportTable(&newClient)
+	} else if err == kismetClient.ErrNotSelect {
+		dlog.Println("The query returned no columns")
+		ilog.Println("Bad -sql: the query must be a select statement")
+		return err
+	} else {
+		dlog.Println("Failed to create a DB Connection:", err)
+		ilog.Println("Failed to read database:", err)
+		return err
+	}
+}
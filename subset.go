@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/AWildBeard/kismetDataTool/kismetClient"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Writes a new kismetdb holding the devices, packets, alerts and data of the -dbFile database
+// that match the row filters
+func doSubset() error {
+	return writeDBCopy("subset", func(path string) (kismetClient.SubsetReport, error) {
+		return kismetClient.WriteSubset(kismetDB, path, dbFilter)
+	})
+}
+
+// Writes a copy of the -dbFile database to the output with write. SQLite needs a file of its own
+// to write to, so the copy is built in a temporary file that is then copied to the output.
+func writeDBCopy(kind string, write func(path string) (kismetClient.SubsetReport, error)) error {
+	dir := ""
+	if sink.path != "" {
+		dir = filepath.Dir(sink.path) // Subsets of large logs may not fit in the temporary directory
+	}
+
+	tempFile, err := ioutil.TempFile(dir, ".kismetDataTool-" + exportMode + "-")
+	if err != nil {
+		ilog.Println("Failed to create a temporary file:", err)
+		return err
+	}
+	tempPath := tempFile.Name()
+	tempFile.Close()
+	os.Remove(tempPath) // SQLite creates the file itself
+	defer os.Remove(tempPath)
+	defer os.Remove(tempPath + "-journal")
+
+	dlog.Println("Writing", kind, "to", tempPath)
+	report, err := write(tempPath)
+	if err != nil {
+		dlog.Println("Failed to write", kind + ":", err)
+		ilog.Println("Failed to export data:", err)
+		return err
+	}
+
+	for table, rows := range report.Rows {
+		dlog.Println("Copied", rows, table)
+	}
+	provenance.setTableRows(report.Rows)
+
+	provenance.setSource(sourceInfo{
+		Type:          "kismetdb",
+		Path:          kismetDB,
+		KismetVersion: report.KismetVersion,
+		DBVersion:     report.DBVersion,
+	})
+
+	subset, err := os.Open(tempPath)
+	if err != nil {
+		return err
+	}
+	defer subset.Close()
+
+	_, err = io.Copy(sink, subset)
+	return err
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"github.com/AWildBeard/kismetDataTool/kismetClient"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// No single column is allowed to grow past this width unless there is room to spare
+	maxCellWidth = 48
+	// Columns are never shrunk below this width
+	minCellWidth = 4
+	// Placed between columns
+	columnGap = "  "
+	// Marks a truncated value
+	ellipsis = "…"
+)
+
+// Returns true if the file is a terminal rather than a pipe or a regular file
+func isTerminal(file *os.File) bool {
+	if info, err := file.Stat(); err == nil {
+		return info.Mode()&os.ModeCharDevice != 0
+	}
+	return false
+}
+
+// Returns the width available for the table. The -width flag wins, then the COLUMNS
+// environment variable that most shells export, then a safe default.
+func terminalWidth() int {
+	if tableWidth > 0 {
+		return tableWidth
+	}
+
+	if columnsEnv, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columnsEnv > 0 {
+		return columnsEnv
+	}
+
+	return 120
+}
+
+// Works out which of the headers were selected with -columns. Columns may be chosen by their
+// header or by their position starting at 1. All columns are selected when nothing was chosen.
+func selectColumns(headers []string, selection string) ([]int, error) {
+	if selection == "" {
+		selected := make([]int, len(headers))
+		for n := range headers {
+			selected[n] = n
+		}
+		return selected, nil
+	}
+
+	selected := make([]int, 0)
+	for _, v := range strings.Split(selection, ",") {
+		v = strings.TrimSpace(v)
+		found := false
+		for n, header := range headers {
+			if header == v {
+				selected = append(selected, n)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			if position, err := strconv.Atoi(v); err == nil && position >= 1 && position <= len(headers) {
+				selected = append(selected, position-1)
+			} else {
+				return nil, fmt.Errorf("no column %q. The columns are: %v", v, strings.Join(headers, ", "))
+			}
+		}
+	}
+
+	return selected, nil
+}
+
+// Writes the elements as an aligned table for reading on a terminal. All elements are read
+// before anything is written as the widths of the columns depend on every row.
+func writeTable(client kismetClient.DataLineReader) error {
+	var (
+		clientGenerator func() (kismetClient.DataElement, error)
+		rows            [][]string
+	)
+
+	dlog.Println("Creating element generator")
+	if newGenerator, err := client.Elements(); err == nil {
+		clientGenerator = newGenerator
+	} else {
+		dlog.Println("Failed to create element generator")
+		return err
+	}
+	provenance.describeColumns(client)
+
+	headers := columnHeaders(client)
+	selected, err := selectColumns(headers, tableColumns)
+	if err != nil {
+		ilog.Println("Bad column selection:", err)
+		return err
+	}
+
+	dlog.Println("Reading elements")
+	for {
+		elem, err := clientGenerator()
+		if err != nil {
+			return err
+		} else if !elem.HasData { // No more elements
+			break
+		}
+
+		provenance.observe(elementValues(elem))
+		values, err := formatElement(elem)
+		if err != nil {
+			return err
+		}
+
+		row := make([]string, len(selected))
+		for n, column := range selected {
+			if column < len(values) {
+				row[n] = valueString(values[column])
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	selectedHeaders := make([]string, len(selected))
+	for n, column := range selected {
+		selectedHeaders[n] = headers[column]
+	}
+
+	widths := columnWidths(selectedHeaders, rows, terminalWidth())
+	numeric := numericColumns(rows, len(selected))
+
+	rule := make([]string, len(widths))
+	for n, v := range widths {
+		rule[n] = strings.Repeat("-", v)
+	}
+	header := tableLine(selectedHeaders, widths, numeric) + tableLine(rule, widths, nil)
+
+	if pageTable && sink.path == "" && isTerminal(os.Stdout) {
+		if pager, pipe, err := startPager(); err == nil {
+			// The pager has to see the end of the table before we wait for the user to quit it
+			defer pager.Wait()
+			defer pipe.Close()
+			return writeTableTo(pipe, header, rows, widths, numeric)
+		} else {
+			dlog.Println("Failed to start pager, writing directly:", err)
+		}
+	}
+
+	// Each row is a record so that the output can be rotated, with every part starting with the
+	// header of the table
+	dlog.Println("Writing table")
+	sink.SetHeader([]byte(header))
+	for _, row := range rows {
+		if err := sink.WriteRecord([]byte(tableLine(row, widths, numeric))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Writes the table to the pager
+func writeTableTo(destination io.Writer, header string, rows [][]string, widths []int, numeric []bool) error {
+	dlog.Println("Writing table")
+	if _, err := io.WriteString(destination, header); err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		if _, err := io.WriteString(destination, tableLine(row, widths, numeric)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Finds how wide every column should be. Each column starts as wide as its widest value (up to
+// maxCellWidth) and the widest columns are narrowed one at a time until the table fits.
+func columnWidths(headers []string, rows [][]string, available int) []int {
+	widths := make([]int, len(headers))
+	for n, v := range headers {
+		widths[n] = utf8.RuneCountInString(v)
+	}
+	for _, row := range rows {
+		for n, v := range row {
+			if width := utf8.RuneCountInString(v); width > widths[n] {
+				widths[n] = width
+			}
+		}
+	}
+
+	total := func() int {
+		sum := len(columnGap) * (len(widths) - 1)
+		for _, v := range widths {
+			sum += v
+		}
+		return sum
+	}
+
+	for n, v := range widths {
+		if v > maxCellWidth && total() > available {
+			widths[n] = maxCellWidth
+		}
+	}
+
+	for total() > available {
+		widest := 0
+		for n, v := range widths {
+			if v > widths[widest] {
+				widest = n
+			}
+		}
+		if widths[widest] <= minCellWidth {
+			break // Too many columns for the terminal. Let the lines wrap.
+		}
+		widths[widest]--
+	}
+
+	return widths
+}
+
+// A column is numeric when every value in it that is not empty is a number
+func numericColumns(rows [][]string, numColumns int) []bool {
+	numeric := make([]bool, numColumns)
+	for n := range numeric {
+		numeric[n] = true
+		seen := false
+		for _, row := range rows {
+			if row[n] == "" {
+				continue
+			}
+			seen = true
+			if _, err := strconv.ParseFloat(row[n], 64); err != nil {
+				numeric[n] = false
+				break
+			}
+		}
+		numeric[n] = numeric[n] && seen
+	}
+	return numeric
+}
+
+// Pads or truncates each cell to its width. Numeric cells are right aligned.
+func tableLine(cells []string, widths []int, numeric []bool) string {
+	var line strings.Builder
+	for n, v := range cells {
+		if n > 0 {
+			line.WriteString(columnGap)
+		}
+
+		cell := truncateCell(v, widths[n])
+		padding := strings.Repeat(" ", widths[n]-utf8.RuneCountInString(cell))
+		if numeric != nil && numeric[n] {
+			line.WriteString(padding)
+			line.WriteString(cell)
+		} else if n == len(cells)-1 {
+			line.WriteString(cell) // No trailing spaces
+		} else {
+			line.WriteString(cell)
+			line.WriteString(padding)
+		}
+	}
+	line.WriteByte('\n')
+	return line.String()
+}
+
+func truncateCell(cell string, width int) string {
+	// Control characters would break the alignment
+	cell = strings.Map(func(r rune) rune {
+		if r < ' ' {
+			return ' '
+		}
+		return r
+	}, cell)
+
+	if utf8.RuneCountInString(cell) <= width {
+		return cell
+	}
+
+	runes := []rune(cell)
+	return string(runes[:width-1]) + ellipsis
+}
+
+// Starts the pager from the PAGER environment variable, or less if it is not set. The table is
+// written to the returned pipe.
+func startPager() (*exec.Cmd, io.WriteCloser, error) {
+	pagerCommand := strings.Fields(os.Getenv("PAGER"))
+	if len(pagerCommand) == 0 {
+		pagerCommand = []string{"less", "-S"}
+	}
+
+	pager := exec.Command(pagerCommand[0], pagerCommand[1:]...)
+	pager.Stdout = os.Stdout
+	pager.Stderr = os.Stderr
+
+	pipe, err := pager.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := pager.Start(); err != nil {
+		return nil, nil, err
+	}
+
+	return pager, pipe, nil
+}
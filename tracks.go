@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/AWildBeard/kismetDataTool/kismetClient"
+	"math"
+	"os"
+	"time"
+)
+
+// ADS-B reports altitudes in feet and KML wants meters
+const metersPerFoot = 0.3048
+
+// A position an aircraft reported
+type trackPoint struct {
+	when time.Time
+	lat, lon float64
+	// In meters. hasAltitude is false when the message didn't have one
+	altitude float64
+	hasAltitude bool
+}
+
+// The positions one aircraft reported, in the order they were heard
+type flight struct {
+	icao string
+	// The latest callsign the aircraft used, if any
+	callsign string
+	points []trackPoint
+}
+
+// Writes the flights of the ADS-B aircraft in the data table of the -dbFile database to a KML
+// file. Each aircraft becomes a placemark with a track of the positions it reported, with their
+// altitude and time, so that Google Earth draws it in the air and can play it back. Messages
+// that don't have a position, such as those that only report the callsign, are left out.
+func doTracks() error {
+	dlog.Println("Creating Kismet client")
+
+	dataClient, err := kismetClient.NewDataClient(kismetDB)
+	if err != nil {
+		dlog.Println("Failed to create a DB Connection:", err)
+		ilog.Println("Failed to read database:", err)
+		return err
+	}
+	defer dataClient.Finish()
+	dataClient.Filter = dbFilter
+
+	provenance.setSource(sourceInfo{
+		Type:          "kismetdb",
+		Path:          kismetDB,
+		KismetVersion: dataClient.KismetVersion,
+		DBVersion:     dataClient.DBVersion,
+	})
+
+	records, err := dataClient.Records()
+	if err != nil {
+		ilog.Println("Failed to export data:", err)
+		return err
+	}
+
+	var (
+		flights = make(map[string]*flight)
+		order []string
+		skipped int
+	)
+
+	for {
+		record, err := records()
+		if err != nil {
+			ilog.Println("Failed to export data:", err)
+			return err
+		} else if record == nil { // No more records
+			break
+		}
+
+		if record.Kind != kismetClient.SensorADSB {
+			continue
+		} else if !record.HasReportedPosition {
+			skipped++
+			continue
+		}
+
+		icao := valueString(record.ICAO)
+		if icao == "" {
+			icao = record.DevMAC
+		}
+
+		current, ok := flights[icao]
+		if !ok {
+			current = &flight{icao: icao}
+			flights[icao] = current
+			order = append(order, icao)
+		}
+		if callsign := valueString(record.Callsign); callsign != "" {
+			current.callsign = callsign
+		}
+
+		point := trackPoint{when: record.Timestamp, lat: record.Lat, lon: record.Lon}
+		if feet, ok := toFloat(record.Altitude); ok && record.Altitude != nil {
+			point.altitude = math.Round(feet * metersPerFoot * 100) / 100
+			point.hasAltitude = true
+		}
+		current.points = append(current.points, point)
+	}
+
+	if _, err := sink.Write([]byte(kmlHeader(kismetDB))); err != nil {
+		return err
+	}
+	for _, v := range order {
+		if err := sink.WriteRecord(kmlTrack(flights[v])); err != nil {
+			return err
+		}
+	}
+	if _, err := sink.Write([]byte(kmlFooter)); err != nil {
+		return err
+	}
+
+	// The KML itself may be going to STDOUT
+	if skipped > 0 {
+		fmt.Fprintln(os.Stderr, "Skipped", skipped, "ADS-B messages without a position")
+	}
+	if len(order) == 0 {
+		fmt.Fprintln(os.Stderr, "No ADS-B aircraft reported a position")
+	}
+
+	return nil
+}
+
+// Returns the start of the KML document, up to the first placemark
+func kmlHeader(source string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2" xmlns:gx="http://www.google.com/kml/ext/2.2">
+<Document>
+  <name>ADS-B tracks from ` + kmlText(source) + `</name>
+  <Style id="aircraft">
+    <IconStyle>
+      <Icon><href>http://maps.google.com/mapfiles/kml/shapes/airports.png</href></Icon>
+    </IconStyle>
+    <LineStyle>
+      <color>ff00aaff</color>
+      <width>2</width>
+    </LineStyle>
+  </Style>
+`
+}
+
+const kmlFooter = `</Document>
+</kml>
+`
+
+// Returns the placemark of a flight. Tracks are drawn at the altitude the aircraft reported.
+// Positions without an altitude would be drawn at sea level, so they are left out of tracks that
+// have altitudes, and tracks without any altitude are drawn on the ground.
+func kmlTrack(current *flight) []byte {
+	altitudeMode := "clampToGround"
+	for _, v := range current.points {
+		if v.hasAltitude {
+			altitudeMode = "absolute"
+			break
+		}
+	}
+
+	var points []trackPoint
+	for _, v := range current.points {
+		if v.hasAltitude || altitudeMode == "clampToGround" {
+			points = append(points, v)
+		}
+	}
+
+	name := current.icao
+	if current.callsign != "" {
+		name = current.callsign
+	}
+
+	var placemark bytes.Buffer
+	placemark.WriteString("  <Placemark>\n")
+	placemark.WriteString("    <name>" + kmlText(name) + "</name>\n")
+	placemark.WriteString(fmt.Sprintf("    <description>ICAO %s. %d positions from %s to %s</description>\n",
+		kmlText(current.icao), len(points), points[0].when.UTC().Format(time.RFC3339),
+		points[len(points) - 1].when.UTC().Format(time.RFC3339)))
+	placemark.WriteString("    <styleUrl>#aircraft</styleUrl>\n")
+	placemark.WriteString("    <gx:Track>\n")
+	placemark.WriteString("      <altitudeMode>" + altitudeMode + "</altitudeMode>\n")
+	for _, v := range points {
+		placemark.WriteString("      <when>" + v.when.UTC().Format(time.RFC3339Nano) + "</when>\n")
+	}
+	for _, v := range points {
+		placemark.WriteString(fmt.Sprintf("      <gx:coord>%s %s %s</gx:coord>\n", valueString(v.lon),
+			valueString(v.lat), valueString(v.altitude)))
+	}
+	placemark.WriteString("    </gx:Track>\n")
+	placemark.WriteString("  </Placemark>\n")
+
+	return placemark.Bytes()
+}
+
+// Escapes text for use in a KML element
+func kmlText(text string) string {
+	var escaped bytes.Buffer
+	xml.EscapeText(&escaped, []byte(text))
+	return escaped.String()
+}